@@ -1,7 +1,12 @@
 package main
 
 import (
+	"os"
+
 	"github.com/alecthomas/kong"
+	"github.com/k1nky/apm/internal/logger"
+	"github.com/k1nky/apm/internal/manager"
+	"github.com/k1nky/apm/internal/parser"
 )
 
 var BuildVersion = "unknown"
@@ -9,11 +14,40 @@ var BuildTarget = "unknown"
 
 func main() {
 	ctx := kong.Parse(&CLI)
+	log := newLogger()
+	logger.SetDefault(log)
 	err := ctx.Run(&Context{
 		Debug:        CLI.Debug,
 		WorkDir:      expandPath(CLI.WorkDir),
 		File:         CLI.File,
 		UseGitConfig: CLI.UseGitConfig,
+		Galaxy: parser.GalaxyOptions{
+			RolesPath:       CLI.RolesPath,
+			CollectionsPath: CLI.CollectionsPath,
+		},
+		Variables: CLI.Vars,
+		Output:    CLI.Output,
+		Logger:    log,
+		Hooks: manager.HookOptions{
+			AllowProvided: CLI.AllowHooks,
+			Timeout:       CLI.HookTimeout,
+		},
 	})
 	ctx.FatalIfErrorf(err)
 }
+
+// newLogger returns a logger according to the flags. Messages are written to stderr
+// when a machine-readable output is requested, so stdout contains the output only.
+func newLogger() logger.Logger {
+	w := os.Stdout
+	if CLI.Output != OutputText {
+		w = os.Stderr
+	}
+	return logger.New(logger.Options{
+		Debug:    CLI.Debug,
+		Quiet:    CLI.Quiet,
+		NoColor:  CLI.NoColor,
+		Progress: logger.ProgressMode(CLI.Progress),
+		Writer:   w,
+	})
+}
@@ -2,8 +2,19 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
 
+	"github.com/Masterminds/semver/v3"
 	"github.com/k1nky/apm/internal/downloader"
+	"github.com/k1nky/apm/internal/logger"
 	"github.com/k1nky/apm/internal/manager"
 	"github.com/k1nky/apm/internal/parser"
 	"github.com/pterm/pterm"
@@ -14,88 +25,528 @@ type Context struct {
 	UseGitConfig bool
 	WorkDir      string
 	File         string
+	Galaxy       parser.GalaxyOptions
+	Variables    map[string]string
+	Output       string
+	Logger       logger.Logger
+	Hooks        manager.HookOptions
 }
 
 var CLI struct {
-	Debug        bool   `help:"Enable debug mode." name:"debug"`
-	WorkDir      string `help:"Working directory with .apm mount point. It is current directory by default" name:"workdir" short:"w" optional:""`
-	UseGitConfig bool   `help:"Use gitconfig to override url" name:"gitconfig" default:"true" optional:"" negatable:""`
-	File         string `help:"Path to a file with requirements" name:"file" short:"f" optional:"" default:"requirements.yml"`
+	Debug           bool              `help:"Enable debug mode." name:"debug"`
+	WorkDir         string            `help:"Working directory with .apm mount point. It is current directory by default" name:"workdir" short:"w" optional:""`
+	UseGitConfig    bool              `help:"Use gitconfig to override url" name:"gitconfig" default:"true" optional:"" negatable:""`
+	File            string            `help:"Path to a file with requirements" name:"file" short:"f" optional:"" default:"requirements.yml"`
+	RolesPath       string            `help:"Directory for roles from ansible-galaxy requirements" name:"roles-path" optional:"" default:"roles"`
+	CollectionsPath string            `help:"Directory for collections from ansible-galaxy requirements" name:"collections-path" optional:"" default:"collections"`
+	Output          string            `help:"Output format: text, json or yaml" name:"output" enum:"text,json,yaml" default:"text"`
+	NoColor         bool              `help:"Disable colors" name:"no-color" optional:""`
+	Quiet           bool              `help:"Print only warnings and errors" name:"quiet" short:"q" optional:""`
+	Progress        string            `help:"Show progress bars: auto (in terminals only), always or never" name:"progress" enum:"auto,always,never" default:"auto"`
+	Vars            map[string]string `help:"Variables for requirements, they take precedence over the environment and vars, e.g. --var key=value" name:"var" optional:""`
+	AllowHooks      bool              `help:"Run hooks declared by packages, hooks of the requirements are always run" name:"allow-hooks" optional:""`
+	HookTimeout     time.Duration     `help:"Time limit of a hook run" name:"hook-timeout" default:"5m"`
 	// TODO: User         string
 	// TODO: AuthType     string
-	Install InstallCmd `cmd:"" help:"Install packages from file"`
-	List    ListCmd    `cmd:"" help:"List remote versions"`
-	Link    LinkCmd    `cmd:"" help:"Link resources"`
-	Version VersionCmd `cmd:"" help:"Show current version" aliases:"v"`
+	Install  InstallCmd  `cmd:"" help:"Install packages from file"`
+	List     ListCmd     `cmd:"" help:"List remote versions"`
+	Fetch    FetchCmd    `cmd:"" help:"Download packages into the storage without changes of the working directory"`
+	Bundle   BundleCmd   `cmd:"" help:"Pack installed packages into an archive which can be installed without network"`
+	Link     LinkCmd     `cmd:"" help:"Link resources"`
+	Remove   RemoveCmd   `cmd:"" help:"Remove links of packages" aliases:"rm"`
+	Validate ValidateCmd `cmd:"" help:"Validate requirements files"`
+	Tree     TreeCmd     `cmd:"" help:"Show installed packages with their dependencies"`
+	Status   StatusCmd   `cmd:"" help:"Show the state of every mapping within the working directory"`
+	Doctor   DoctorCmd   `cmd:"" help:"Diagnose and repair broken installations"`
+	Convert  ConvertCmd  `cmd:"" help:"Convert ansible-galaxy requirements into the native format"`
+	Version  VersionCmd  `cmd:"" help:"Show current version" aliases:"v"`
 }
 
 type InstallCmd struct {
+	Force   bool     `help:"Reinstall packages even if they are up to date" name:"force" optional:"" default:"false"`
+	Group   []string `help:"Install only packages without groups and from the groups. The selection is remembered" name:"group" short:"g" optional:""`
+	Without []string `help:"Do not install packages from the groups. The selection is remembered" name:"without" optional:""`
+	All     bool     `help:"Install all groups and forget the remembered selection" name:"all" optional:"" default:"false"`
+	NoDeps  bool     `help:"Do not install dependencies declared by packages" name:"no-deps" optional:"" default:"false"`
+	Offline bool     `help:"Install packages from the storage only, e.g. fetched by apm fetch" name:"offline" optional:"" default:"false"`
+	Bundle  string   `help:"Install packages from the archive made by apm bundle, it implies --offline" name:"from-bundle" type:"existingfile" optional:""`
+}
+
+type BundleCmd struct {
+	Archive string `help:"Path to the archive" name:"archive" short:"o" required:"" type:"path"`
+}
+
+type FetchCmd struct {
+	Group   []string `help:"Fetch only packages without groups and from the groups" name:"group" short:"g" optional:""`
+	Without []string `help:"Do not fetch packages from the groups" name:"without" optional:""`
+	NoDeps  bool     `help:"Do not fetch dependencies declared by packages" name:"no-deps" optional:"" default:"false"`
+}
+
+type TreeCmd struct {
 }
 
 type VersionCmd struct {
 }
 
+type StatusCmd struct {
+}
+
+type DoctorCmd struct {
+	Fix bool `help:"Repair found problems" name:"fix" optional:"" default:"false"`
+}
+
 type LinkCmd struct {
-	Url  string `help:"Package URL, will be skipped when installation from file is set." name:"url" short:"u" arg:"" placeholder:"url" optional:""`
-	Dest string `help:"Destitaion." name:"dest" short:"d" arg:"" placeholder:"dest" optional:""`
-	Save bool   `help:"Save added package to requirements" name:"save" short:"s" optional:"" default:"false"`
-	// TODO: NoLink bool
-	// TODO: Force bool
+	Url     string `help:"Package spec url[@version][#src]" name:"url" short:"u" arg:"" placeholder:"package"`
+	Dest    string `help:"Destitaion." name:"dest" short:"d" arg:"" placeholder:"dest"`
+	Version string `help:"Version of the package, it overrides the version of the spec" name:"version" optional:""`
+	Src     string `help:"Source path within the package, it overrides the path of the spec" name:"src" optional:""`
+	Save    bool   `help:"Save added package to requirements" name:"save" short:"s" optional:"" default:"false"`
+	NoLink  bool   `help:"Place the package into the storage without a link at the destination, e.g. to prefetch it" name:"no-link" optional:"" default:"false"`
+	Force   bool   `help:"Move an existing destination which is not a link aside with the suffix .apm-backup and replace it" name:"force" optional:"" default:"false"`
+	Yes     bool   `help:"Do not ask for confirmation of --force" name:"yes" short:"y" optional:"" default:"false"`
+}
+
+type RemoveCmd struct {
+	Targets []string `help:"Destinations or package specs url[@version][#src] of mappings in requirements" arg:"" placeholder:"dest|package"`
+	Save    bool     `help:"Remove the mappings from requirements" name:"save" short:"s" optional:"" default:"false"`
+}
+
+type ValidateCmd struct {
+	Files []string `help:"Paths to files with requirements. The file from --file is used by default" arg:"" placeholder:"file" optional:""`
+}
+
+type ConvertCmd struct {
+	Dest string `help:"Path to the converted file. The source file is rewritten by default" arg:"" placeholder:"dest" optional:""`
 }
 
 type ListCmd struct {
-	Url string `help:"Package URL" arg:"" placeholder:"url" required:""`
+	Url      string `help:"Package spec url[@version], refs which the version resolves to are listed. It is skipped when --dest is set" arg:"" placeholder:"package" optional:""`
+	Dest     string `help:"List refs which the mapping with the destination in requirements resolves to" name:"dest" short:"d" optional:""`
+	Tags     bool   `help:"List tags only" name:"tags" optional:"" default:"false"`
+	Branches bool   `help:"List branches only" name:"branches" optional:"" default:"false"`
+	Semver   bool   `help:"Order semantic versions by their precedence, the newest first, other refs follow them" name:"semver" optional:"" default:"false"`
+	Limit    int    `help:"Maximum number of refs to list" name:"limit" short:"n" optional:""`
+	Match    string `help:"List refs with names matching the regular expression" name:"match" short:"m" optional:""`
+	Dates    bool   `help:"Show dates of the last commits, the commits of the listed refs are fetched" name:"dates" optional:"" default:"false"`
 }
 
 func (cmd *InstallCmd) Run(ctx *Context) error {
-	m := manager.Manager{}
+	m, err := manager.New(&manager.Options{
+		WorkDir: ctx.WorkDir,
+		Logger:  ctx.Logger,
+	})
+	if err != nil {
+		ctx.Logger.Error(err)
+		return err
+	}
 
-	requirements, err := loadRequirements(ctx.File)
+	requirements, err := loadRequirements(ctx)
 	if err != nil {
-		pterm.Error.Println(err)
+		ctx.Logger.Error(err)
 		return err
 	}
 
-	packages := make([]*manager.Package, 0)
-	opts := &manager.InstallOptions{
-		WorkDir: ctx.WorkDir,
+	state, err := cmd.selectGroups(ctx, m)
+	if err != nil {
+		ctx.Logger.Error(err)
+		return err
 	}
-	for _, pkg := range requirements.Packages {
-		for _, mpg := range pkg.Mappings {
-			packages = append(packages, &manager.Package{
-				URL:     overrideUrl(pkg.Url, ctx.UseGitConfig),
-				Src:     mpg.Src,
-				Version: mpg.Version,
-				Dest:    mpg.Dest,
-			})
-		}
-		if err := m.Install(packages, opts); err != nil {
-			pterm.Error.Println(err)
+
+	if cmd.Bundle != "" {
+		if err := importBundle(ctx, m, cmd.Bundle); err != nil {
+			ctx.Logger.Error(err)
 			return err
 		}
-		packages = packages[:0]
+		cmd.Offline = true
 	}
-	return nil
+	if cmd.Force && cmd.Offline {
+		err := fmt.Errorf("--force can not be used offline")
+		ctx.Logger.Error(err)
+		return err
+	}
+	lock, err := loadLockfile(ctx)
+	if err != nil {
+		ctx.Logger.Error(err)
+		return err
+	}
+	opts := installOptions(ctx, requirements)
+	opts.Force, opts.NoDeps, opts.Offline, opts.Lock = cmd.Force, cmd.NoDeps, cmd.Offline, lock
+	selected := parser.Select(requirements.AllPackages(), state.Groups, state.Without)
+	results, err := m.Install(toPackages(selected, ctx), opts)
+	if err != nil {
+		ctx.Logger.Error(err)
+		return err
+	}
+	// locked mappings of groups which are not selected are kept
+	others := make(map[string]bool)
+	for _, pkg := range requirements.AllPackages() {
+		for _, mapping := range pkg.Mappings {
+			others[path.Clean(mapping.Dest)] = true
+		}
+	}
+	for _, pkg := range selected {
+		for _, mapping := range pkg.Mappings {
+			delete(others, path.Clean(mapping.Dest))
+		}
+	}
+	if err := saveLockfile(ctx, lock, results, func(dest string) bool { return others[path.Clean(dest)] }); err != nil {
+		return err
+	}
+	return printResults(ctx, results)
 }
 
-func (cmd *LinkCmd) Run(ctx *Context) error {
+func (cmd *FetchCmd) Run(ctx *Context) error {
+	m, err := manager.New(&manager.Options{
+		WorkDir: ctx.WorkDir,
+		Logger:  ctx.Logger,
+		NoSetup: true,
+	})
+	if err != nil {
+		ctx.Logger.Error(err)
+		return err
+	}
 
-	m := manager.Manager{}
+	requirements, err := loadRequirements(ctx)
+	if err != nil {
+		ctx.Logger.Error(err)
+		return err
+	}
 
-	requirements, err := loadRequirements(ctx.File)
+	lock, err := loadLockfile(ctx)
+	if err != nil {
+		ctx.Logger.Error(err)
+		return err
+	}
+	opts := installOptions(ctx, requirements)
+	opts.NoDeps, opts.Lock = cmd.NoDeps, lock
+	packages := toPackages(parser.Select(requirements.AllPackages(), cmd.Group, cmd.Without), ctx)
+	results, err := m.Fetch(packages, opts)
 	if err != nil {
-		pterm.Error.Println(err)
+		ctx.Logger.Error(err)
 		return err
 	}
+	return printResults(ctx, results)
+}
 
-	packages := make([]*manager.Package, 0)
-	// url := overrideUrl(cmd.Url, ctx.UseGitConfig)
-	opts := &manager.InstallOptions{
+func (cmd *BundleCmd) Run(ctx *Context) error {
+	m, err := manager.New(&manager.Options{
 		WorkDir: ctx.WorkDir,
+		Logger:  ctx.Logger,
+	})
+	if err != nil {
+		ctx.Logger.Error(err)
+		return err
+	}
+
+	requirements, err := loadRequirements(ctx)
+	if err != nil {
+		ctx.Logger.Error(err)
+		return err
+	}
+
+	state, err := m.LoadState()
+	if err != nil {
+		ctx.Logger.Error(err)
+		return err
+	}
+
+	// the archive is written next to the destination and renamed, so it is never left incomplete
+	tmp, err := ioutil.TempFile(filepath.Dir(cmd.Archive), "."+filepath.Base(cmd.Archive)+".tmp-")
+	if err != nil {
+		ctx.Logger.Error(err)
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	results, err := m.Bundle(toPackages(parser.Select(requirements.AllPackages(), state.Groups, state.Without), ctx), tmp)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), cmd.Archive)
+	}
+	if err != nil {
+		ctx.Logger.Error(err)
+		return err
+	}
+	ctx.Logger.Success(fmt.Sprintf("%d packages are packed into %s", len(results), cmd.Archive))
+	return printOutput(ctx, results, func() {})
+}
+
+func (cmd *TreeCmd) Run(ctx *Context) error {
+	m, err := manager.New(&manager.Options{
+		WorkDir: ctx.WorkDir,
+		Logger:  ctx.Logger,
+	})
+	if err != nil {
+		ctx.Logger.Error(err)
+		return err
+	}
+
+	requirements, err := loadRequirements(ctx)
+	if err != nil {
+		ctx.Logger.Error(err)
+		return err
+	}
+
+	state, err := m.LoadState()
+	if err != nil {
+		ctx.Logger.Error(err)
+		return err
+	}
+
+	nodes := m.Tree(toPackages(parser.Select(requirements.AllPackages(), state.Groups, state.Without), ctx))
+	tree := make([]treeNode, 0, len(nodes))
+	root := pterm.TreeNode{Text: ctx.File}
+	for _, n := range nodes {
+		tree = append(tree, newTreeNode(m, n))
+		root.Children = append(root.Children, printableTree(n))
+	}
+	return printOutput(ctx, tree, func() {
+		pterm.DefaultTree.WithRoot(root).Render()
+	})
+}
+
+func (cmd *StatusCmd) Run(ctx *Context) error {
+	m, err := manager.New(&manager.Options{
+		WorkDir: ctx.WorkDir,
+		Logger:  ctx.Logger,
+	})
+	if err != nil {
+		ctx.Logger.Error(err)
+		return err
+	}
+
+	requirements, err := loadRequirements(ctx)
+	if err != nil {
+		ctx.Logger.Error(err)
+		return err
+	}
+
+	state, err := m.LoadState()
+	if err != nil {
+		ctx.Logger.Error(err)
+		return err
+	}
+
+	lock, err := loadLockfile(ctx)
+	if err != nil {
+		ctx.Logger.Error(err)
+		return err
+	}
+
+	statuses, err := m.Status(toPackages(parser.Select(requirements.AllPackages(), state.Groups, state.Without), ctx), lock)
+	if err != nil {
+		ctx.Logger.Error(err)
+		return err
+	}
+	outOfSync := 0
+	for _, s := range statuses {
+		if !s.InSync() {
+			outOfSync++
+		}
+	}
+	if err := printOutput(ctx, statuses, func() { printStatuses(statuses) }); err != nil {
+		return err
+	}
+	if outOfSync > 0 {
+		return fmt.Errorf("%d of %d mappings are out of sync", outOfSync, len(statuses))
+	}
+	return nil
+}
+
+func (cmd *DoctorCmd) Run(ctx *Context) error {
+	m, err := manager.New(&manager.Options{
+		WorkDir: ctx.WorkDir,
+		Logger:  ctx.Logger,
+	})
+	if err != nil {
+		ctx.Logger.Error(err)
+		return err
+	}
+
+	requirements, err := loadRequirements(ctx)
+	if err != nil {
+		ctx.Logger.Error(err)
+		return err
+	}
+
+	state, err := m.LoadState()
+	if err != nil {
+		ctx.Logger.Error(err)
+		return err
+	}
+
+	lock, err := loadLockfile(ctx)
+	if err != nil {
+		ctx.Logger.Error(err)
+		return err
+	}
+
+	opts := installOptions(ctx, requirements)
+	opts.Lock = lock
+	problems, err := m.Doctor(toPackages(parser.Select(requirements.AllPackages(), state.Groups, state.Without), ctx), &manager.DoctorOptions{
+		Fix:     cmd.Fix,
+		Install: opts,
+	})
+	if err != nil {
+		ctx.Logger.Error(err)
+		return err
+	}
+	unfixed := 0
+	for _, p := range problems {
+		if !p.Fixed {
+			unfixed++
+		}
+	}
+	if err := printOutput(ctx, problems, func() {
+		for _, p := range problems {
+			switch {
+			case p.Fixed:
+				ctx.Logger.Success(fmt.Sprintf("%s: %s, fixed: %s", p.Path, p.Detail, p.Fix))
+			case p.Error != "":
+				ctx.Logger.Error(fmt.Sprintf("%s: %s, failed to %s: %s", p.Path, p.Detail, p.Fix, p.Error))
+			default:
+				ctx.Logger.Warning(fmt.Sprintf("%s: %s, --fix will %s", p.Path, p.Detail, p.Fix))
+			}
+		}
+		if len(problems) == 0 {
+			ctx.Logger.Success("No problems found")
+		}
+	}); err != nil {
+		return err
+	}
+	if unfixed > 0 {
+		return fmt.Errorf("%d of %d problems are not fixed", unfixed, len(problems))
+	}
+	return nil
+}
+
+// printStatuses prints a line per mapping, the states are colored
+func printStatuses(statuses []*manager.MappingStatus) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, s := range statuses {
+		state := string(s.State)
+		switch s.State {
+		case manager.MappingInstalled:
+			state = pterm.Green(state)
+		case manager.MappingOrphaned:
+			state = pterm.Gray(state)
+		default:
+			state = pterm.Red(state)
+		}
+		dest := s.Dest
+		if dest == "" {
+			dest = "-"
+		}
+		line := fmt.Sprintf("%s\t%s\t%s", state, dest, manager.Package{URL: s.URL, Version: s.Installed, Src: s.Src})
+		if s.Installed != s.Required && s.Required != "" {
+			line += fmt.Sprintf(" (required %s)", s.Required)
+		}
+		if s.Detail != "" {
+			line += fmt.Sprintf(" (%s)", s.Detail)
+		}
+		fmt.Fprintln(w, line)
+	}
+	w.Flush()
+}
+
+// printableTree describes the package with its dependencies
+func printableTree(n *manager.Node) pterm.TreeNode {
+	p := n.Package
+	text := fmt.Sprintf("%s %s", p.Dest, p)
+	switch {
+	case n.Err != nil:
+		text += pterm.Red(fmt.Sprintf(" (%s)", n.Err))
+	case n.Conflicts():
+		text += pterm.Yellow(fmt.Sprintf(" (conflict, %s is used)", n.Duplicate.Package))
+	case n.Duplicate != nil:
+		text += pterm.Gray(" (deduplicated)")
+	}
+	node := pterm.TreeNode{Text: text}
+	for _, child := range n.Children {
+		node.Children = append(node.Children, printableTree(child))
+	}
+	return node
+}
+
+// selectGroups returns the groups from the command line and remembers them,
+// the previous selection is used when no groups are passed
+func (cmd *InstallCmd) selectGroups(ctx *Context, m *manager.Manager) (*manager.State, error) {
+	state, err := m.LoadState()
+	if err != nil {
+		return nil, err
+	}
+	if !cmd.All && len(cmd.Group) == 0 && len(cmd.Without) == 0 {
+		if len(state.Groups) > 0 || len(state.Without) > 0 {
+			ctx.Logger.Info(fmt.Sprintf("Using groups %v without %v", state.Groups, state.Without))
+		}
+		return state, nil
+	}
+	state.Groups, state.Without = cmd.Group, cmd.Without
+	if err := m.SaveState(state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+func (cmd *LinkCmd) Run(ctx *Context) error {
+
+	if cmd.Force && cmd.NoLink {
+		err := fmt.Errorf("--force and --no-link can not be used together")
+		ctx.Logger.Error(err)
+		return err
+	}
+	pkg, err := manager.ParsePackage(cmd.Url)
+	if err != nil {
+		ctx.Logger.Error(err)
+		return err
+	}
+	if cmd.Version != "" {
+		pkg.Version = cmd.Version
+	}
+	if cmd.Src != "" {
+		pkg.Src = cmd.Src
 	}
-	pkg := manager.PackageFromString(cmd.Url)
 	pkg.Dest = cmd.Dest
-	packages = append(packages, pkg)
+	// the package is checked before the working directory and requirements are touched
+	if err := pkg.Validate(); err != nil {
+		ctx.Logger.Error(err)
+		return err
+	}
+	if cmd.Force && !cmd.Yes && !logger.IsTerminal(os.Stdin) {
+		err := fmt.Errorf("--force can not be confirmed without a terminal, use -y")
+		ctx.Logger.Error(err)
+		return err
+	}
+
+	m, err := manager.New(&manager.Options{
+		WorkDir: ctx.WorkDir,
+		Logger:  ctx.Logger,
+	})
+	if err != nil {
+		ctx.Logger.Error(err)
+		return err
+	}
+
+	requirements, err := loadRequirements(ctx)
+	if err != nil {
+		ctx.Logger.Error(err)
+		return err
+	}
+
+	lock, err := loadLockfile(ctx)
+	if err != nil {
+		ctx.Logger.Error(err)
+		return err
+	}
+
+	opts := installOptions(ctx, requirements)
+	opts.NoLink, opts.Lock = cmd.NoLink, lock
+	if cmd.Force {
+		opts.Overwrite = func(dest string) bool {
+			return cmd.Yes || confirm(ctx, fmt.Sprintf("%s exists and is not a link, move it aside and replace?", dest))
+		}
+	}
 	requirements.Add(parser.RequiredPackage{
 		// use original url to prevent unexpected overriding
 		Url: pkg.URL,
@@ -107,31 +558,297 @@ func (cmd *LinkCmd) Run(ctx *Context) error {
 			},
 		},
 	})
-	if err := m.Install(packages, opts); err != nil {
-		pterm.Error.Println(err)
+	// the url is rewritten for the installation only, the original one is saved
+	install := *pkg
+	install.URL = overrideUrl(ctx, pkg.URL)
+	results, err := m.Install([]*manager.Package{&install}, opts)
+	if err != nil {
+		ctx.Logger.Error(err)
 		return err
 	}
 
 	if cmd.Save {
-		saveRequirements(ctx.File, requirements)
+		if err := saveRequirements(ctx, ctx.File, requirements); err != nil {
+			return err
+		}
+		if err := saveLockfile(ctx, lock, results, func(string) bool { return true }); err != nil {
+			return err
+		}
 	}
 
-	return nil
+	return printResults(ctx, results)
+}
+
+func (cmd *RemoveCmd) Run(ctx *Context) error {
+	m, err := manager.New(&manager.Options{
+		WorkDir: ctx.WorkDir,
+		Logger:  ctx.Logger,
+	})
+	if err != nil {
+		ctx.Logger.Error(err)
+		return err
+	}
+
+	requirements, err := loadRequirements(ctx)
+	if err != nil {
+		ctx.Logger.Error(err)
+		return err
+	}
+
+	packages := make([]*manager.Package, 0)
+	for _, target := range cmd.Targets {
+		matched, err := matchMappings(ctx, requirements.AllPackages(), target)
+		if err != nil {
+			ctx.Logger.Error(err)
+			return err
+		}
+		packages = append(packages, matched...)
+	}
+	results, err := m.Remove(packages, &manager.RemoveOptions{Hooks: ctx.Hooks})
+	if err != nil {
+		ctx.Logger.Error(err)
+		return err
+	}
+
+	if cmd.Save {
+		removed := make(map[string]bool)
+		for _, r := range results {
+			if r.Status != manager.StatusRemoved {
+				continue
+			}
+			removed[path.Clean(r.Dest)] = true
+			if !requirements.Remove(r.Dest) && r.URL != "" {
+				ctx.Logger.Warning(fmt.Sprintf("%s is not removed from %s, it is included from another file", r.Dest, ctx.File))
+			}
+		}
+		if err := saveRequirements(ctx, ctx.File, requirements); err != nil {
+			return err
+		}
+		lock, err := loadLockfile(ctx)
+		if err != nil {
+			ctx.Logger.Error(err)
+			return err
+		}
+		if err := saveLockfile(ctx, lock, nil, func(dest string) bool { return !removed[path.Clean(dest)] }); err != nil {
+			return err
+		}
+	}
+
+	return printResults(ctx, results)
+}
+
+// matchMappings returns the mappings with the destination `target` or the mappings of the package spec `target`.
+// A destination which is not in requirements is matched when it exists.
+func matchMappings(ctx *Context, packages []parser.RequiredPackage, target string) ([]*manager.Package, error) {
+	byDest := make([]*manager.Package, 0)
+	bySpec := make([]*manager.Package, 0)
+	spec, specErr := manager.ParsePackage(target)
+	for _, p := range toPackages(packages, ctx) {
+		if path.Clean(p.Dest) == path.Clean(target) {
+			byDest = append(byDest, p)
+			continue
+		}
+		if specErr != nil || p.URL != overrideUrl(ctx, spec.URL) {
+			continue
+		}
+		if (spec.Version == "" || spec.Version == p.Version) && (spec.Src == "" || path.Clean(spec.Src) == path.Clean(p.Src)) {
+			bySpec = append(bySpec, p)
+		}
+	}
+	switch {
+	case len(byDest) > 0:
+		return byDest, nil
+	case len(bySpec) > 0:
+		return bySpec, nil
+	}
+	dest := target
+	if !path.IsAbs(dest) {
+		dest = path.Join(ctx.WorkDir, dest)
+	}
+	if _, err := os.Lstat(dest); err == nil {
+		return []*manager.Package{{Dest: target}}, nil
+	}
+	return nil, fmt.Errorf("no mappings match %s", target)
 }
 
 func (cmd *ListCmd) Run(ctx *Context) (err error) {
-	var versions []string
+	var (
+		revs  []*downloader.Revision
+		match *regexp.Regexp
+	)
+	if cmd.Tags && cmd.Branches {
+		return fmt.Errorf("--tags and --branches can not be used together")
+	}
+	if cmd.Match != "" {
+		if match, err = regexp.Compile(cmd.Match); err != nil {
+			return fmt.Errorf("invalid --match: %s", err)
+		}
+	}
+	var url, required string
+	if cmd.Dest != "" {
+		if url, required, err = cmd.mapping(ctx); err != nil {
+			ctx.Logger.Error(err)
+			return
+		}
+	} else if cmd.Url == "" {
+		return fmt.Errorf("package or --dest is expected")
+	} else {
+		pkg, err := manager.ParsePackage(cmd.Url)
+		if err != nil {
+			return err
+		}
+		url, required = overrideUrl(ctx, pkg.URL), pkg.Version
+	}
+
 	d := downloader.NewDownloader()
-	url := overrideUrl(cmd.Url, ctx.UseGitConfig)
-	versions, err = d.FetchVersion(url, nil)
-	for _, v := range versions {
-		fmt.Println(v)
+	d.Logger = ctx.Logger
+	if revs, err = d.ListRefs(url, nil); err != nil {
+		return
+	}
+	listed := make([]*downloader.Revision, 0, len(revs))
+	versions := make(map[string]*semver.Version)
+	for _, rev := range revs {
+		switch {
+		case cmd.Tags && rev.Type != downloader.RefTag,
+			cmd.Branches && rev.Type != downloader.RefBranch,
+			match != nil && !match.MatchString(rev.Version),
+			required != "" && !manager.Satisfies(rev.Version, required) && !strings.HasPrefix(rev.Commit, required):
+			continue
+		}
+		if v, err := semver.NewVersion(rev.Version); err == nil {
+			versions[rev.Version] = v
+		}
+		listed = append(listed, rev)
+	}
+	if cmd.Semver {
+		sort.SliceStable(listed, func(i, j int) bool {
+			vi, vj := versions[listed[i].Version], versions[listed[j].Version]
+			if vi == nil || vj == nil {
+				return vj == nil && vi != nil
+			}
+			return vi.GreaterThan(vj)
+		})
+	}
+	if cmd.Limit > 0 && len(listed) > cmd.Limit {
+		listed = listed[:cmd.Limit]
+	}
+	if cmd.Dates {
+		if err := d.CommitDates(url, listed, nil); err != nil {
+			ctx.Logger.Warning(fmt.Sprintf("dates of commits of %s are not fetched: %s", url, err))
+		}
+	}
+	refs := make([]ref, 0, len(listed))
+	for _, rev := range listed {
+		r := ref{Name: rev.Version, Type: string(rev.Type), Commit: rev.Commit, Default: rev.Default}
+		if !rev.Date.IsZero() {
+			r.Date = rev.Date.Format(time.RFC3339)
+		}
+		refs = append(refs, r)
 	}
 
+	return printOutput(ctx, refs, func() {
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		for _, r := range refs {
+			line := fmt.Sprintf("%s\t%s\t%s", r.Name, r.Type, r.Commit[:shortCommitLength])
+			if r.Date != "" {
+				line += "\t" + r.Date
+			}
+			if r.Default {
+				line += "\t(default)"
+			}
+			fmt.Fprintln(w, line)
+		}
+		w.Flush()
+	})
+}
+
+// mapping returns the url and the version of the package which is installed into --dest by requirements
+func (cmd *ListCmd) mapping(ctx *Context) (url string, version string, err error) {
+	requirements, err := loadRequirements(ctx)
+	if err != nil {
+		return
+	}
+	for _, pkg := range requirements.AllPackages() {
+		for _, m := range pkg.Mappings {
+			if path.Clean(m.Dest) != path.Clean(cmd.Dest) {
+				continue
+			}
+			version = m.Version
+			if v, ok := requirements.Overrides[pkg.Url]; ok {
+				version = v
+			}
+			if version == "" {
+				version = manager.DefaultVersion
+			}
+			return overrideUrl(ctx, pkg.Url), version, nil
+		}
+	}
+	return "", "", fmt.Errorf("%s is not found in %s", cmd.Dest, ctx.File)
+}
+
+func (cmd *ValidateCmd) Run(ctx *Context) (err error) {
+	files := cmd.Files
+	if len(files) == 0 {
+		files = []string{ctx.File}
+	}
+	results := make([]validation, 0, len(files))
+	for _, f := range files {
+		result := validateFile(ctx, f)
+		for _, e := range result.Errors {
+			ctx.Logger.Error(e)
+		}
+		if !result.Valid {
+			err = fmt.Errorf("%s is invalid", f)
+		}
+		results = append(results, result)
+	}
+	if perr := printOutput(ctx, results, func() {}); perr != nil {
+		return perr
+	}
 	return
 }
 
+// validateFile reads the requirements file and collects its errors
+func validateFile(ctx *Context, filename string) validation {
+	result := validation{File: filename}
+	file, err := os.Open(filename)
+	if err != nil {
+		result.Errors = []*parser.ValidationError{{Filename: filename, Message: err.Error()}}
+		return result
+	}
+	defer file.Close()
+
+	err = newRequirements(ctx, filename).Read(file)
+	if errs, ok := err.(parser.ValidationErrors); ok {
+		result.Errors = errs
+	} else if err != nil {
+		result.Errors = []*parser.ValidationError{{Filename: filename, Message: err.Error()}}
+	} else {
+		result.Valid = true
+	}
+	return result
+}
+
+func (cmd *ConvertCmd) Run(ctx *Context) (err error) {
+	requirements, err := loadRequirements(ctx)
+	if err != nil {
+		ctx.Logger.Error(err)
+		return err
+	}
+	output := cmd.Dest
+	if output == "" {
+		output = ctx.File
+	}
+	requirements.Format = parser.NativeFormat
+	if err = saveRequirements(ctx, output, requirements); err != nil {
+		return err
+	}
+	ctx.Logger.Success(fmt.Sprintf("%s is converted to %s", ctx.File, output))
+	return nil
+}
+
 func (cmd *VersionCmd) Run(ctx *Context) (err error) {
-	fmt.Printf("%s %s\n", BuildTarget, BuildVersion)
-	return
+	return printOutput(ctx, newBuildInfo(), func() {
+		fmt.Printf("%s %s\n", BuildTarget, BuildVersion)
+	})
 }
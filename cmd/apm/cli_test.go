@@ -1 +1,29 @@
 package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/k1nky/apm/internal/logger"
+)
+
+func TestLinkForceWithoutTerminal(t *testing.T) {
+	dir := t.TempDir()
+	stdin, err := os.Create(filepath.Join(dir, "stdin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdin.Close()
+	saved := os.Stdin
+	os.Stdin = stdin
+	defer func() { os.Stdin = saved }()
+
+	cmd := &LinkCmd{Url: "https://example.com/repo.git@v1.0", Dest: "roles/a", Force: true}
+	ctx := &Context{WorkDir: dir, File: filepath.Join(dir, "requirements.yml"), Logger: logger.Discard{}}
+	err = cmd.Run(ctx)
+	if err == nil || !strings.Contains(err.Error(), "use -y") {
+		t.Fatalf("expected an error asking for -y, got %v", err)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+
+	"github.com/k1nky/apm/internal/manager"
+	"github.com/k1nky/apm/internal/parser"
+	"gopkg.in/yaml.v3"
+)
+
+// shortCommitLength is the length of abbreviated commit hashes in the text output
+const shortCommitLength = 8
+
+const (
+	OutputText = "text"
+	OutputJSON = "json"
+	OutputYAML = "yaml"
+)
+
+// ref is a branch or a tag of a remote repository
+type ref struct {
+	Name    string `json:"name" yaml:"name"`
+	Type    string `json:"type" yaml:"type"`
+	Commit  string `json:"commit" yaml:"commit"`
+	Date    string `json:"date,omitempty" yaml:"date,omitempty"`
+	Default bool   `json:"default,omitempty" yaml:"default,omitempty"`
+}
+
+// treeNode is a package with its dependencies
+type treeNode struct {
+	manager.Result `yaml:",inline"`
+	Dependencies   []treeNode `json:"dependencies,omitempty" yaml:"dependencies,omitempty"`
+}
+
+// validation is a result of a requirements file validation
+type validation struct {
+	File   string                    `json:"file" yaml:"file"`
+	Valid  bool                      `json:"valid" yaml:"valid"`
+	Errors []*parser.ValidationError `json:"errors,omitempty" yaml:"errors,omitempty"`
+}
+
+type buildInfo struct {
+	Version   string `json:"version" yaml:"version"`
+	Target    string `json:"target" yaml:"target"`
+	GoVersion string `json:"go_version" yaml:"go_version"`
+}
+
+// printOutput writes `v` to stdout in the format chosen by --output, `text` is used for the text format
+func printOutput(ctx *Context, v interface{}, text func()) error {
+	switch ctx.Output {
+	case OutputJSON:
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(v)
+	case OutputYAML:
+		encoder := yaml.NewEncoder(os.Stdout)
+		encoder.SetIndent(2)
+		if err := encoder.Encode(v); err != nil {
+			return err
+		}
+		return encoder.Close()
+	case OutputText, "":
+		text()
+		return nil
+	}
+	return fmt.Errorf("unsupported output format %s", ctx.Output)
+}
+
+// printResults prints results of packages, an error is returned when any of them is failed
+// so the exit code reflects failures in every output format
+func printResults(ctx *Context, results []*manager.Result) error {
+	if err := printOutput(ctx, results, func() {}); err != nil {
+		return err
+	}
+	failed := 0
+	for _, r := range results {
+		if r.Status == manager.StatusFailed {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d packages are failed", failed, len(results))
+	}
+	return nil
+}
+
+func newBuildInfo() buildInfo {
+	return buildInfo{
+		Version:   BuildVersion,
+		Target:    BuildTarget,
+		GoVersion: runtime.Version(),
+	}
+}
+
+func newTreeNode(m *manager.Manager, n *manager.Node) treeNode {
+	node := treeNode{Result: *m.Result(n)}
+	for _, child := range n.Children {
+		node.Dependencies = append(node.Dependencies, newTreeNode(m, child))
+	}
+	return node
+}
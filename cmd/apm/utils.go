@@ -1,62 +1,171 @@
 package main
 
 import (
+	"fmt"
+	"io/ioutil"
 	"os"
 	"os/user"
 	"path/filepath"
 	"strings"
 
 	"github.com/k1nky/apm/internal/downloader"
+	"github.com/k1nky/apm/internal/logger"
+	"github.com/k1nky/apm/internal/manager"
 	"github.com/k1nky/apm/internal/parser"
-	"github.com/sirupsen/logrus"
+	"github.com/pterm/pterm"
 )
 
-func overrideUrl(url string, useGitConfig bool) string {
-	newUrl, err := downloader.RewriteUrl(url, useGitConfig)
+func overrideUrl(ctx *Context, url string) string {
+	newUrl, err := downloader.RewriteUrl(url, ctx.UseGitConfig)
 	if err != nil {
-		logrus.Fatal(err)
-		return ""
+		ctx.Logger.Error(err)
+		return url
 	}
-	logrus.Debugf("override url %s to %s", url, newUrl)
+	ctx.Logger.Debug(fmt.Sprintf("override url %s to %s", url, newUrl))
 	return newUrl
 }
 
-func loadRequirements(filename string) (req *parser.Requirements, err error) {
-	file, err := os.Open(filename)
+// fetchFile returns a function which reads a file from a repository for remote includes
+func fetchFile(ctx *Context) parser.FetchFunc {
+	return func(url string, version string, p string) ([]byte, error) {
+		dir, err := ioutil.TempDir("", manager.DefaultTmpPrefix)
+		if err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(dir)
+
+		d := downloader.NewDownloader()
+		d.Logger = ctx.Logger
+		if err := d.Get(overrideUrl(ctx, url), version, dir, nil); err != nil {
+			return nil, err
+		}
+		return ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(p)))
+	}
+}
+
+func newRequirements(ctx *Context, filename string) *parser.Requirements {
+	return &parser.Requirements{
+		Filename:  filename,
+		Format:    parser.NativeFormat,
+		Galaxy:    ctx.Galaxy,
+		Variables: ctx.Variables,
+		Fetch:     fetchFile(ctx),
+	}
+}
+
+func loadRequirements(ctx *Context) (req *parser.Requirements, err error) {
+	req = newRequirements(ctx, ctx.File)
+	file, err := os.Open(ctx.File)
 	if os.IsNotExist(err) {
-		return &parser.Requirements{}, nil
+		return req, nil
 	} else if err != nil {
 		return nil, err
 	}
 	defer file.Close()
 
-	req = &parser.Requirements{}
 	err = req.Read(file)
 
 	return req, err
 }
 
-func saveRequirements(filename string, req *parser.Requirements) error {
-	file, err := os.Create(filename)
-	if err != nil {
-		logrus.Error(err)
+func saveRequirements(ctx *Context, filename string, req *parser.Requirements) error {
+	if req != nil && req.Format == parser.GalaxyFormat {
+		err := fmt.Errorf("%s is in ansible-galaxy format, convert it with `apm convert` before saving", filename)
+		ctx.Logger.Error(err)
 		return err
 	}
-	defer file.Close()
-
 	if req == nil {
-		logrus.Warn("nothing to save")
+		ctx.Logger.Warning("nothing to save")
 		return nil
 	}
 
-	if err := req.Write(file); err != nil {
-		logrus.Error(err)
+	if err := req.WriteFile(filename); err != nil {
+		ctx.Logger.Error(err)
 		return err
 	}
 
 	return nil
 }
 
+// loadLockfile reads the lockfile next to the requirements file
+func loadLockfile(ctx *Context) (*manager.Lockfile, error) {
+	return manager.ReadLockfile(manager.LockfilePath(ctx.File))
+}
+
+// saveLockfile locks the installed mappings of the results, the entries of other destinations are kept
+// when `keep` reports them. An empty lockfile is not created.
+func saveLockfile(ctx *Context, lock *manager.Lockfile, results []*manager.Result, keep func(dest string) bool) error {
+	name := manager.LockfilePath(ctx.File)
+	lock.Update(results, keep)
+	if _, err := os.Stat(name); os.IsNotExist(err) && len(lock.Packages) == 0 {
+		return nil
+	}
+	if err := lock.WriteFile(name); err != nil {
+		ctx.Logger.Error(err)
+		return err
+	}
+	return nil
+}
+
+// toPackages returns the packages to install from the requirements
+func toPackages(requirements []parser.RequiredPackage, ctx *Context) []*manager.Package {
+	packages := make([]*manager.Package, 0)
+	for _, pkg := range requirements {
+		for _, mpg := range pkg.Mappings {
+			packages = append(packages, &manager.Package{
+				URL:      overrideUrl(ctx, pkg.Url),
+				Src:      mpg.Src,
+				Version:  mpg.Version,
+				Dest:     mpg.Dest,
+				Hooks:    manager.NewHooks(mpg.Hooks, false),
+				Template: manager.NewTemplate(mpg.Template),
+				Patches:  mpg.Patches,
+			})
+		}
+	}
+	return packages
+}
+
+// installOptions returns options which rewrite urls of dependencies and apply overrides of the requirements
+func installOptions(ctx *Context, requirements *parser.Requirements) *manager.InstallOptions {
+	opts := &manager.InstallOptions{
+		RewriteUrl: func(url string) string {
+			return overrideUrl(ctx, url)
+		},
+		Overrides: make(map[string]string),
+		Hooks:     ctx.Hooks,
+	}
+	for url, version := range requirements.Overrides {
+		opts.Overrides[overrideUrl(ctx, url)] = version
+	}
+	return opts
+}
+
+// importBundle places packages of the archive into the storage
+func importBundle(ctx *Context, m *manager.Manager, archive string) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	manifest, err := m.Storage.Import(f)
+	if err != nil {
+		return fmt.Errorf("%s: %s", archive, err)
+	}
+	ctx.Logger.Info(fmt.Sprintf("Imported %d packages from %s", len(manifest.Entries), archive))
+	return nil
+}
+
+// confirm asks the question in a terminal, it is declined without a terminal
+func confirm(ctx *Context, question string) bool {
+	if !logger.IsTerminal(os.Stdin) {
+		ctx.Logger.Warning(question + " Declined, use --yes to confirm without a terminal")
+		return false
+	}
+	answer, err := pterm.DefaultInteractiveConfirm.Show(question)
+	return err == nil && answer
+}
+
 func expandPath(p string) string {
 	if strings.HasPrefix(p, "~") {
 		usr, _ := user.Current()
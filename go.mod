@@ -5,11 +5,15 @@ go 1.17
 require (
 	github.com/alecthomas/kong v0.2.22
 	github.com/go-git/go-git/v5 v5.4.2
-	github.com/sirupsen/logrus v1.4.2
-	gopkg.in/yaml.v2 v2.4.0
 )
 
-require github.com/pterm/pterm v0.12.59
+require (
+	github.com/Masterminds/semver/v3 v3.2.1
+	github.com/pterm/pterm v0.12.59
+	golang.org/x/sys v0.6.0
+	golang.org/x/term v0.6.0
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require (
 	atomicgo.dev/cursor v0.1.1 // indirect
@@ -26,7 +30,6 @@ require (
 	github.com/imdario/mergo v0.3.12 // indirect
 	github.com/jbenet/go-context v0.0.0-20150711004518-d14ea06fba99 // indirect
 	github.com/kevinburke/ssh_config v0.0.0-20201106050909-4977a11b4351 // indirect
-	github.com/konsorten/go-windows-terminal-sequences v1.0.1 // indirect
 	github.com/lithammer/fuzzysearch v1.1.5 // indirect
 	github.com/mattn/go-runewidth v0.0.14 // indirect
 	github.com/mitchellh/go-homedir v1.1.0 // indirect
@@ -37,8 +40,7 @@ require (
 	github.com/xo/terminfo v0.0.0-20220910002029-abceb7e1c41e // indirect
 	golang.org/x/crypto v0.0.0-20210921155107-089bfa567519 // indirect
 	golang.org/x/net v0.6.0 // indirect
-	golang.org/x/sys v0.6.0 // indirect
-	golang.org/x/term v0.6.0 // indirect
 	golang.org/x/text v0.9.0 // indirect
 	gopkg.in/warnings.v0 v0.1.2 // indirect
+	gopkg.in/yaml.v2 v2.4.0 // indirect
 )
@@ -112,9 +112,19 @@ func CopyFile(src string, dest string) (int64, error) {
 	return nBytes, err
 }
 
+// CopyLink makes a symlink `dest` pointing to the same target as the symlink `src`.
+func CopyLink(src string, dest string) error {
+	target, err := os.Readlink(src)
+	if err != nil {
+		return err
+	}
+	return os.Symlink(target, dest)
+}
+
 // CopyDir makes recursive copy of a directory into another directory.
 // If the destination directory does not exist it will be created.
 // If set `plain` to true content of `src` directory will be placed into `dest` directory.
+// Copying stops on the first error, so a partial copy is never reported as a successful one.
 func CopyDir(src string, dest string, plain bool) (err error) {
 	var fds []os.FileInfo
 	var srcInfo os.FileInfo
@@ -137,13 +147,17 @@ func CopyDir(src string, dest string, plain bool) (err error) {
 		srcfp := path.Join(src, fd.Name())
 		dstfp := path.Join(dest, fd.Name())
 
-		if fd.IsDir() {
+		if fd.Mode()&os.ModeSymlink != 0 {
+			if err = CopyLink(srcfp, dstfp); err != nil {
+				return err
+			}
+		} else if fd.IsDir() {
 			if err = CopyDir(srcfp, dstfp, true); err != nil {
-				fmt.Println(err)
+				return err
 			}
 		} else {
 			if _, err = CopyFile(srcfp, dstfp); err != nil {
-				fmt.Println(err)
+				return err
 			}
 		}
 	}
@@ -1,21 +1,27 @@
 package downloader
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	gourl "net/url"
 	"os"
+	"path"
+	"regexp"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/config"
 	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
 	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/client"
 	"github.com/go-git/go-git/v5/plumbing/transport/http"
 	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
 	"github.com/go-git/go-git/v5/storage/memory"
-	"github.com/sirupsen/logrus"
+	"github.com/k1nky/apm/internal/logger"
 )
 
 const (
@@ -26,6 +32,34 @@ const (
 
 type AuthType int
 
+// listTimeout limits listing of references of a remote repository
+const listTimeout = 10 * time.Second
+
+// RefType is a kind of git reference a version is resolved to
+type RefType string
+
+const (
+	RefBranch RefType = "branch"
+	RefTag    RefType = "tag"
+	RefCommit RefType = "commit"
+)
+
+// Revision describes a version resolved to a commit
+type Revision struct {
+	Version string
+	Type    RefType
+	Commit  string
+	// Default is set for the branch which HEAD of the remote repository points to
+	Default bool
+	// Date is a date of the commit, it is zero when the commit is not fetched
+	Date time.Time
+}
+
+// IsImmutable reports whether the revision is not expected to move over time.
+func (r *Revision) IsImmutable() bool {
+	return r.Type == RefTag || r.Type == RefCommit
+}
+
 type Options struct {
 	// TODO: Override existing directory
 	Override   bool
@@ -35,8 +69,12 @@ type Options struct {
 	OnlySwitch bool
 }
 
+// Downloader fetches packages from git repositories. It is safe for concurrent use.
 type Downloader struct {
+	// options are used when options are not passed to a call
 	options *Options
+	// Logger is logger.Default() when it is not set
+	Logger logger.Logger
 }
 
 func NewDownloader() *Downloader {
@@ -45,6 +83,13 @@ func NewDownloader() *Downloader {
 	}
 }
 
+func (d *Downloader) log() logger.Logger {
+	if d.Logger == nil {
+		return logger.Default()
+	}
+	return d.Logger
+}
+
 func DefaultOptions() *Options {
 	return &Options{
 		Override:   true,
@@ -57,15 +102,15 @@ func (options *Options) Validate() (err error) {
 	return nil
 }
 
-func (d *Downloader) auth() (method transport.AuthMethod, err error) {
-	switch d.options.Auth {
+func (d *Downloader) auth(options *Options) (method transport.AuthMethod, err error) {
+	switch options.Auth {
 	case NoAuth:
 	case SSHAgentAuth:
 		method, err = ssh.NewSSHAgentAuth("")
 	case BasicAuth:
 		method = &http.BasicAuth{
-			Username: d.options.Username,
-			Password: d.options.Password,
+			Username: options.Username,
+			Password: options.Password,
 		}
 	default:
 		err = errors.New("unsupported auth method")
@@ -74,17 +119,17 @@ func (d *Downloader) auth() (method transport.AuthMethod, err error) {
 	return
 }
 
-func (d *Downloader) clone(dir string, url string) (err error) {
+func (d *Downloader) clone(dir string, url string, options *Options) (err error) {
 	cloneOptions := &git.CloneOptions{
 		URL:          url,
 		SingleBranch: false,
 		Tags:         git.AllTags,
 		RemoteName:   "origin",
 	}
-	if logrus.GetLevel() < logrus.ErrorLevel {
-		cloneOptions.Progress = os.Stdout
+	if w := d.log().DebugWriter(); w != nil {
+		cloneOptions.Progress = w
 	}
-	if method, err := d.auth(); err != nil {
+	if method, err := d.auth(options); err != nil {
 		return err
 	} else if method != nil {
 		cloneOptions.Auth = method
@@ -94,22 +139,101 @@ func (d *Downloader) clone(dir string, url string) (err error) {
 	return
 }
 
-func (d *Downloader) retrieveRemoteVersion(url string, options *Options) (versions []string, err error) {
-	listOptions := &git.ListOptions{
-		InsecureSkipTLS: true,
+// listRemote lists references of the remote repository. Annotated tags are peeled, so every tag refers to a commit.
+func (d *Downloader) listRemote(url string, options *Options) (refs []*plumbing.Reference, err error) {
+	method, err := d.auth(options)
+	if err != nil {
+		return nil, err
 	}
-	if method, err := d.auth(); err != nil {
-		return versions, err
-	} else if method != nil {
-		listOptions.Auth = method
+	ep, err := transport.NewEndpoint(url)
+	if err != nil {
+		return nil, err
 	}
+	ep.InsecureSkipTLS = true
+	c, err := client.NewClient(ep)
+	if err != nil {
+		return nil, err
+	}
+	s, err := c.NewUploadPackSession(ep, method)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
 
-	remrepo := git.NewRemote(memory.NewStorage(), &config.RemoteConfig{
-		Name: "origin",
-		URLs: []string{url},
+	ctx, cancel := context.WithTimeout(context.Background(), listTimeout)
+	defer cancel()
+	ar, err := s.AdvertisedReferencesContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	all, err := ar.AllReferences()
+	if err != nil {
+		return nil, err
+	}
+	iter, err := all.IterReferences()
+	if err != nil {
+		return nil, err
+	}
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		// the remote advertises commits of annotated tags as `<tag>^{}`
+		if commit, ok := ar.Peeled[ref.Name().String()]; ok {
+			ref = plumbing.NewHashReference(ref.Name(), commit)
+		}
+		refs = append(refs, ref)
+		return nil
 	})
+	return refs, err
+}
 
-	refs, err := remrepo.List(listOptions)
+// CommitDates sets dates of the commits of the branches and tags `revs` of the remote repository. Only the last
+// commits of the refs are fetched into memory, so the refs should be filtered before.
+func (d *Downloader) CommitDates(url string, revs []*Revision, options *Options) (err error) {
+	var refspecs []config.RefSpec
+
+	for _, rev := range revs {
+		switch rev.Type {
+		case RefBranch:
+			refspecs = append(refspecs, config.RefSpec(fmt.Sprintf("+refs/heads/%s:refs/remotes/origin/%s", rev.Version, rev.Version)))
+		case RefTag:
+			refspecs = append(refspecs, config.RefSpec(fmt.Sprintf("+refs/tags/%s:refs/tags/%s", rev.Version, rev.Version)))
+		}
+	}
+	if len(refspecs) == 0 {
+		return nil
+	}
+	if options, err = d.prepare(url, options); err != nil {
+		return
+	}
+	fetchOptions := &git.FetchOptions{
+		RefSpecs:        refspecs,
+		Depth:           1,
+		Tags:            git.NoTags,
+		InsecureSkipTLS: true,
+	}
+	if fetchOptions.Auth, err = d.auth(options); err != nil {
+		return
+	}
+	repo, err := git.Init(memory.NewStorage(), nil)
+	if err != nil {
+		return
+	}
+	remote, err := repo.CreateRemote(&config.RemoteConfig{Name: "origin", URLs: []string{url}})
+	if err != nil {
+		return
+	}
+	if err = remote.Fetch(fetchOptions); err != nil && err != git.NoErrAlreadyUpToDate {
+		return
+	}
+	for _, rev := range revs {
+		if c, err := repo.CommitObject(plumbing.NewHash(rev.Commit)); err == nil {
+			rev.Date = c.Committer.When
+		}
+	}
+	return nil
+}
+
+func (d *Downloader) retrieveRemoteVersion(url string, options *Options) (versions []string, err error) {
+	refs, err := d.listRemote(url, options)
 	if err != nil {
 		return versions, err
 	}
@@ -122,9 +246,31 @@ func (d *Downloader) retrieveRemoteVersion(url string, options *Options) (versio
 	return
 }
 
+// RemoteRevision resolves `version` against references of the remote repository without cloning it.
+// Only branches and tags can be resolved in this way.
+func (d *Downloader) RemoteRevision(url string, version string, options *Options) (rev *Revision, err error) {
+	var refs []*plumbing.Reference
+
+	if options, err = d.prepare(url, options); err != nil {
+		return
+	}
+	if refs, err = d.listRemote(url, options); err != nil {
+		return
+	}
+	for _, ref := range refs {
+		switch ref.Name() {
+		case plumbing.NewBranchReferenceName(version):
+			return &Revision{Version: version, Type: RefBranch, Commit: ref.Hash().String()}, nil
+		case plumbing.NewTagReferenceName(version):
+			return &Revision{Version: version, Type: RefTag, Commit: ref.Hash().String()}, nil
+		}
+	}
+	return nil, fmt.Errorf("version %s not found", version)
+}
+
 func RewriteURLFromGitConfig(url string) string {
 	if cfg, err := config.LoadConfig(config.GlobalScope); err != nil {
-		logrus.Debug(err)
+		logger.Default().Debug(err)
 	} else {
 		for _, section := range cfg.Raw.Sections {
 			if section.Name == "url" {
@@ -141,13 +287,41 @@ func RewriteURLFromGitConfig(url string) string {
 	return url
 }
 
+// scpPattern matches scp-like urls, e.g. `git@github.com:k1nky/apm.git`
+var scpPattern = regexp.MustCompile(`^[\w.-]+@[\w.-]+:`)
+
+// IsSCPLike reports whether `url` is an scp-like url, e.g. `git@github.com:k1nky/apm.git`
+func IsSCPLike(url string) bool {
+	return scpPattern.MatchString(url)
+}
+
+// isLocalPath reports whether `url` refers to a repository within the file system
+func isLocalPath(url string) bool {
+	for _, prefix := range []string{"/", "./", "../", "~"} {
+		if strings.HasPrefix(url, prefix) {
+			return true
+		}
+	}
+	info, err := os.Stat(url)
+	return err == nil && info.IsDir()
+}
+
+// RewriteUrl returns the url which is used to access the repository. Urls without a scheme are
+// considered as https ones unless they are scp-like or local paths. Rules `insteadOf` of the global git config
+// are applied when `useGitConfig` is set.
 func RewriteUrl(url string, useGitConfig bool) (newUrl string, err error) {
 	newUrl = url
-	if !strings.HasPrefix(url, "http") && !strings.HasPrefix(url, "ssh") {
+	switch {
+	case strings.Contains(url, "://"):
+		if _, err = gourl.Parse(url); err != nil {
+			return
+		}
+	case IsSCPLike(url), isLocalPath(url):
+	default:
 		newUrl = "https://" + url
-	}
-	if _, err = gourl.Parse(newUrl); err != nil {
-		return
+		if _, err = gourl.Parse(newUrl); err != nil {
+			return
+		}
 	}
 
 	if useGitConfig {
@@ -157,20 +331,20 @@ func RewriteUrl(url string, useGitConfig bool) (newUrl string, err error) {
 	return
 }
 
-func (d *Downloader) prepare(url string, options *Options) (err error) {
+// prepare returns a copy of `options` adjusted for `url`, so the downloader can be used concurrently.
+func (d *Downloader) prepare(url string, options *Options) (prepared *Options, err error) {
 	if options == nil {
-		d.options = DefaultOptions()
-	} else {
-		d.options = options
+		options = d.options
 	}
-	if err = d.options.Validate(); err != nil {
+	opts := *options
+	if err = opts.Validate(); err != nil {
 		return
 	}
 
-	if strings.HasPrefix(url, "ssh") {
-		d.options.Auth = SSHAgentAuth
+	if strings.HasPrefix(url, "ssh") || IsSCPLike(url) {
+		opts.Auth = SSHAgentAuth
 	}
-	return
+	return &opts, nil
 }
 
 // Get a package from `url` with `version` to `dest` directory.
@@ -178,12 +352,12 @@ func (d *Downloader) prepare(url string, options *Options) (err error) {
 // Default version is 'master'.
 func (d *Downloader) Get(url string, version string, dest string, options *Options) (err error) {
 
-	if err = d.prepare(url, options); err != nil {
+	if options, err = d.prepare(url, options); err != nil {
 		return
 	}
 
-	if !d.options.OnlySwitch {
-		if err = d.clone(dest, url); err != nil {
+	if !options.OnlySwitch {
+		if err = d.clone(dest, url, options); err != nil {
 			return
 		}
 	}
@@ -192,8 +366,58 @@ func (d *Downloader) Get(url string, version string, dest string, options *Optio
 	return
 }
 
+// ListRefs returns branches and tags of the remote repository ordered by their names.
+// The branch which HEAD points to is marked as default. Dates of the commits are not set, see CommitDates.
+func (d *Downloader) ListRefs(url string, options *Options) (revs []*Revision, err error) {
+	var (
+		refs []*plumbing.Reference
+		head *plumbing.Reference
+	)
+
+	if options, err = d.prepare(url, options); err != nil {
+		return
+	}
+	if refs, err = d.listRemote(url, options); err != nil {
+		return
+	}
+	for _, ref := range refs {
+		if ref.Name() == plumbing.HEAD {
+			head = ref
+			break
+		}
+	}
+	for _, ref := range refs {
+		rev := &Revision{Version: ref.Name().Short(), Commit: ref.Hash().String()}
+		if head != nil && head.Type() == plumbing.SymbolicReference {
+			rev.Default = head.Target() == ref.Name()
+		}
+		switch {
+		case ref.Name().IsTag():
+			rev.Type = RefTag
+		case ref.Name().IsBranch():
+			rev.Type = RefBranch
+		default:
+			continue
+		}
+		revs = append(revs, rev)
+	}
+	sort.Slice(revs, func(i, j int) bool {
+		return revs[i].Version < revs[j].Version
+	})
+	if head != nil && head.Type() == plumbing.HashReference {
+		// the server does not advertise where HEAD points to, so guess the branch by the commit
+		for _, rev := range revs {
+			if rev.Type == RefBranch && rev.Commit == head.Hash().String() {
+				rev.Default = true
+				break
+			}
+		}
+	}
+	return
+}
+
 func (d *Downloader) FetchVersion(url string, options *Options) (versions []string, err error) {
-	if err = d.prepare(url, options); err != nil {
+	if options, err = d.prepare(url, options); err != nil {
 		return
 	}
 
@@ -202,9 +426,22 @@ func (d *Downloader) FetchVersion(url string, options *Options) (versions []stri
 	return
 }
 
-func (d *Downloader) Switch(dir string, version string) (err error) {
+// IsCommitHash reports whether `version` is a full commit SHA.
+func IsCommitHash(version string) bool {
+	if len(version) != 40 {
+		return false
+	}
+	for _, c := range version {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// Resolve returns a revision which `version` points to within the cloned repository `dir`.
+func (d *Downloader) Resolve(dir string, version string) (rev *Revision, err error) {
 	var (
-		wt   *git.Worktree
 		hash *plumbing.Hash
 		repo *git.Repository
 	)
@@ -216,20 +453,78 @@ func (d *Downloader) Switch(dir string, version string) (err error) {
 	}
 	// Workaround: https://github.com/go-git/go-git/issues/148#issuecomment-989635832
 	repo.ResolveRevision(plumbing.Revision("HEAD"))
-	for _, rev := range revisions {
-		if hash, err = repo.ResolveRevision(rev); err == nil {
+	for _, r := range revisions {
+		if hash, err = repo.ResolveRevision(r); err == nil {
 			break
 		}
 		hash = nil
 	}
 	if hash == nil {
-		return fmt.Errorf("version not found")
+		return nil, fmt.Errorf("version not found")
+	}
+
+	rev = &Revision{
+		Version: version,
+		Type:    RefCommit,
+		Commit:  hash.String(),
+	}
+	if _, err := repo.Reference(plumbing.NewTagReferenceName(version), false); err == nil {
+		rev.Type = RefTag
+	} else if _, err := repo.Reference(plumbing.NewRemoteReferenceName("origin", version), false); err == nil {
+		rev.Type = RefBranch
+	} else if _, err := repo.Reference(plumbing.NewBranchReferenceName(version), false); err == nil {
+		rev.Type = RefBranch
+	}
+	return rev, nil
+}
+
+// Tree returns a git hash of `src` tree (or blob if `src` is a file) at `commit` within the cloned repository `dir`.
+// The hash identifies the content regardless of a repository url or a version.
+func (d *Downloader) Tree(dir string, commit string, src string) (hash string, err error) {
+	var (
+		repo   *git.Repository
+		cobj   *object.Commit
+		tree   *object.Tree
+		entry  *object.TreeEntry
+		source = path.Clean(src)
+	)
+
+	if repo, err = git.PlainOpen(dir); err != nil {
+		return
+	}
+	if cobj, err = repo.CommitObject(plumbing.NewHash(commit)); err != nil {
+		return
+	}
+	if tree, err = cobj.Tree(); err != nil {
+		return
+	}
+	if source == "." || source == "/" {
+		return tree.Hash.String(), nil
+	}
+	if entry, err = tree.FindEntry(strings.TrimPrefix(source, "/")); err != nil {
+		return "", fmt.Errorf("%s: %w", src, err)
+	}
+	return entry.Hash.String(), nil
+}
+
+func (d *Downloader) Switch(dir string, version string) (err error) {
+	var (
+		wt   *git.Worktree
+		rev  *Revision
+		repo *git.Repository
+	)
+
+	if rev, err = d.Resolve(dir, version); err != nil {
+		return
+	}
+	if repo, err = git.PlainOpen(dir); err != nil {
+		return
 	}
 	if wt, err = repo.Worktree(); err != nil {
 		return
 	}
 	err = wt.Checkout(&git.CheckoutOptions{
-		Hash: *hash,
+		Hash: plumbing.NewHash(rev.Commit),
 	})
 	return
 }
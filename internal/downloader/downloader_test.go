@@ -10,6 +10,11 @@ import (
 	"os"
 	"path"
 	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
 )
 
 const (
@@ -123,3 +128,94 @@ func TestGetByBranch(t *testing.T) {
 func tearDown(tmpdir string) {
 	os.RemoveAll(tmpdir)
 }
+
+func TestListRefs(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := git.PlainInit(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path.Join(dir, "README"), []byte("test"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wt.Add("README"); err != nil {
+		t.Fatal(err)
+	}
+	when := time.Now().Add(-time.Hour)
+	hash, err := wt.Commit("init", &git.CommitOptions{
+		Author: &object.Signature{Name: "apm", Email: "apm@localhost", When: when},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.CreateTag("v1.0", hash, nil); err != nil {
+		t.Fatal(err)
+	}
+	// annotated tags refer to tag objects rather than commits
+	if _, err := repo.CreateTag("v1.1", hash, &git.CreateTagOptions{
+		Tagger:  &object.Signature{Name: "apm", Email: "apm@localhost", When: time.Now()},
+		Message: "v1.1",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Storer.SetReference(plumbing.NewHashReference(plumbing.NewBranchReferenceName("dev"), hash)); err != nil {
+		t.Fatal(err)
+	}
+
+	revs, err := NewDownloader().ListRefs("file://"+dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Revision{
+		{Version: "dev", Type: RefBranch, Commit: hash.String()},
+		{Version: "master", Type: RefBranch, Commit: hash.String(), Default: true},
+		{Version: "v1.0", Type: RefTag, Commit: hash.String()},
+		{Version: "v1.1", Type: RefTag, Commit: hash.String()},
+	}
+	if len(revs) != len(want) {
+		t.Fatalf("got %d refs, want %d", len(revs), len(want))
+	}
+	for k, rev := range revs {
+		if *rev != want[k] {
+			t.Errorf("got %+v, want %+v", *rev, want[k])
+		}
+	}
+	// dates are fetched for the given refs only
+	if err := NewDownloader().CommitDates("file://"+dir, revs[1:], nil); err != nil {
+		t.Fatal(err)
+	}
+	if !revs[0].Date.IsZero() {
+		t.Errorf("%s: the date is not expected to be fetched", revs[0].Version)
+	}
+	for _, rev := range revs[1:] {
+		if rev.Date.Unix() != when.Unix() {
+			t.Errorf("%s: got date %s, want %s", rev.Version, rev.Date, when)
+		}
+	}
+	rev, err := NewDownloader().RemoteRevision("file://"+dir, "v1.1", nil)
+	if err != nil || rev.Commit != hash.String() {
+		t.Errorf("the annotated tag is expected to be resolved to the commit, got %+v, %v", rev, err)
+	}
+}
+
+func TestRewriteUrl(t *testing.T) {
+	dir := t.TempDir()
+	cases := map[string]string{
+		"github.com/k1nky/apm":               "https://github.com/k1nky/apm",
+		"https://github.com/k1nky/apm":       "https://github.com/k1nky/apm",
+		"ssh://git@github.com/k1nky/apm.git": "ssh://git@github.com/k1nky/apm.git",
+		"git@github.com:k1nky/apm.git":       "git@github.com:k1nky/apm.git",
+		"file:///srv/repo":                   "file:///srv/repo",
+		"./repo":                             "./repo",
+		dir:                                  dir,
+	}
+	for url, want := range cases {
+		if got, err := RewriteUrl(url, false); err != nil || got != want {
+			t.Errorf("%s: got %s, want %s (%v)", url, got, want, err)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+// Package flock provides advisory file locks which are used to serialize access to shared directories
+// by concurrent apm processes and goroutines.
+package flock
+
+import (
+	"os"
+	"path"
+)
+
+const mode0644 = 0644
+
+// Lock is an exclusive advisory lock held on a file
+type Lock struct {
+	f *os.File
+}
+
+// Acquire blocks until an exclusive lock on the file `name` is obtained.
+// The file and its parent directories are created if missing.
+func Acquire(name string) (l *Lock, err error) {
+	var f *os.File
+
+	if err = os.MkdirAll(path.Dir(name), 0755); err != nil {
+		return
+	}
+	if f, err = os.OpenFile(name, os.O_CREATE|os.O_RDWR, mode0644); err != nil {
+		return
+	}
+	if err = lock(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &Lock{f: f}, nil
+}
+
+// Release releases the lock. The lock file is kept to avoid races with other processes waiting for it.
+func (l *Lock) Release() error {
+	if l == nil || l.f == nil {
+		return nil
+	}
+	defer func() {
+		l.f.Close()
+		l.f = nil
+	}()
+	return unlock(l.f)
+}
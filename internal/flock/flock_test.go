@@ -0,0 +1,44 @@
+package flock
+
+import (
+	"path"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAcquireExclusive(t *testing.T) {
+	name := path.Join(t.TempDir(), "dir", ".lock")
+	counter, max := 0, 0
+	mu := sync.Mutex{}
+	wg := sync.WaitGroup{}
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l, err := Acquire(name)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			counter++
+			if counter > max {
+				max = counter
+			}
+			mu.Unlock()
+			time.Sleep(time.Millisecond)
+			mu.Lock()
+			counter--
+			mu.Unlock()
+			if err := l.Release(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if max != 1 {
+		t.Errorf("lock is held by %d owners at once", max)
+	}
+}
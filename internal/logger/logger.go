@@ -0,0 +1,185 @@
+// Package logger provides the only way packages report messages and progress,
+// so the output is consistent in terminals and in CI logs.
+package logger
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/pterm/pterm"
+	"golang.org/x/term"
+)
+
+// ProgressMode controls whether progress bars are shown
+type ProgressMode string
+
+const (
+	// ProgressAuto shows progress bars in terminals only
+	ProgressAuto   ProgressMode = "auto"
+	ProgressAlways ProgressMode = "always"
+	ProgressNever  ProgressMode = "never"
+)
+
+// Logger reports messages and progress of operations
+type Logger interface {
+	Debug(a ...interface{})
+	Info(a ...interface{})
+	Success(a ...interface{})
+	Warning(a ...interface{})
+	Error(a ...interface{})
+	// Progress starts a progress of `total` steps
+	Progress(title string, total int) Progress
+	// DebugWriter returns a writer for verbose output of underlying tools, e.g. git.
+	// It is nil when the output should not be shown.
+	DebugWriter() io.Writer
+}
+
+// Progress tracks steps of an operation
+type Progress interface {
+	UpdateTitle(title string)
+	Increment()
+	// Grow adds `n` steps to the total
+	Grow(n int)
+	Stop()
+}
+
+type Options struct {
+	Debug bool
+	// Quiet suppresses everything except warnings and errors
+	Quiet   bool
+	NoColor bool
+	// Progress is ProgressAuto by default
+	Progress ProgressMode
+	// Writer receives messages, os.Stdout is used by default
+	Writer io.Writer
+}
+
+var (
+	defaultMu sync.Mutex
+	// defaultLogger is created on first use, since New configures pterm globally and
+	// it must not happen before the options are known
+	defaultLogger Logger
+)
+
+// Default returns the logger used by packages when a logger is not passed explicitly
+func Default() Logger {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	if defaultLogger == nil {
+		defaultLogger = New(Options{})
+	}
+	return defaultLogger
+}
+
+// SetDefault replaces the default logger
+func SetDefault(l Logger) {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	defaultLogger = l
+}
+
+// IsTerminal reports whether `w` is a terminal
+func IsTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	// character devices like /dev/null are not terminals
+	return ok && term.IsTerminal(int(f.Fd()))
+}
+
+// New returns a logger for the options. Terminals get colored messages and progress bars,
+// other writers get plain lines, so the output is readable in CI logs.
+func New(opts Options) Logger {
+	if opts.Writer == nil {
+		opts.Writer = os.Stdout
+	}
+	tty := IsTerminal(opts.Writer)
+	progress := false
+	switch opts.Progress {
+	case ProgressAlways:
+		progress = true
+	case ProgressNever:
+	default:
+		progress = tty && !opts.Quiet
+	}
+	if !tty || opts.NoColor || os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+		// pterm colors are global, so the rest of the output is plain as well
+		pterm.DisableColor()
+	}
+	if tty {
+		return newPtermLogger(opts, progress)
+	}
+	return &plainLogger{opts: opts, progress: progress}
+}
+
+// plainLogger writes a line per message without colors and escape codes
+type plainLogger struct {
+	mu       sync.Mutex
+	opts     Options
+	progress bool
+}
+
+func (l *plainLogger) println(level string, a ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fmt.Fprintln(l.opts.Writer, append([]interface{}{level}, a...)...)
+}
+
+func (l *plainLogger) Debug(a ...interface{}) {
+	if l.opts.Debug {
+		l.println("DEBUG", a...)
+	}
+}
+
+func (l *plainLogger) Info(a ...interface{}) {
+	if !l.opts.Quiet {
+		l.println("INFO", a...)
+	}
+}
+
+func (l *plainLogger) Success(a ...interface{}) {
+	if !l.opts.Quiet {
+		l.println("SUCCESS", a...)
+	}
+}
+
+func (l *plainLogger) Warning(a ...interface{}) {
+	l.println("WARNING", a...)
+}
+
+func (l *plainLogger) Error(a ...interface{}) {
+	l.println("ERROR", a...)
+}
+
+func (l *plainLogger) Progress(title string, total int) Progress {
+	if l.progress {
+		return startProgressbar(l.opts.Writer, title, total)
+	}
+	return noProgress{}
+}
+
+func (l *plainLogger) DebugWriter() io.Writer {
+	if l.opts.Debug {
+		return l.opts.Writer
+	}
+	return nil
+}
+
+// noProgress is used when progress bars are disabled
+type noProgress struct{}
+
+func (noProgress) UpdateTitle(title string) {}
+func (noProgress) Increment()               {}
+func (noProgress) Grow(n int)               {}
+func (noProgress) Stop()                    {}
+
+// Discard is a logger which drops all messages
+type Discard struct{}
+
+func (Discard) Debug(a ...interface{})                    {}
+func (Discard) Info(a ...interface{})                     {}
+func (Discard) Success(a ...interface{})                  {}
+func (Discard) Warning(a ...interface{})                  {}
+func (Discard) Error(a ...interface{})                    {}
+func (Discard) Progress(title string, total int) Progress { return noProgress{} }
+func (Discard) DebugWriter() io.Writer                    { return nil }
@@ -0,0 +1,49 @@
+package logger
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestPlainLogger(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := New(Options{Writer: buf})
+	if _, ok := l.(*plainLogger); !ok {
+		t.Fatalf("expected plain logger for non-terminal writer, got %T", l)
+	}
+	l.Info("installing", "role")
+	l.Debug("hidden")
+	l.Warning("careful")
+	if got, want := buf.String(), "INFO installing role\nWARNING careful\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if _, ok := l.Progress("test", 1).(noProgress); !ok {
+		t.Error("expected no progress bar for non-terminal writer")
+	}
+}
+
+func TestQuiet(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := New(Options{Writer: buf, Quiet: true, Debug: true})
+	l.Info("info")
+	l.Success("success")
+	l.Error("failed")
+	if got, want := buf.String(), "ERROR failed\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if l.DebugWriter() == nil {
+		t.Error("expected debug writer")
+	}
+}
+
+func TestIsTerminal(t *testing.T) {
+	f, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if IsTerminal(f) {
+		t.Errorf("%s is not a terminal", os.DevNull)
+	}
+}
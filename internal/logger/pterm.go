@@ -0,0 +1,96 @@
+package logger
+
+import (
+	"io"
+
+	"github.com/pterm/pterm"
+)
+
+// ptermLogger prints messages with pterm prefixes
+type ptermLogger struct {
+	opts     Options
+	progress bool
+
+	debug, info, success, warning, error *pterm.PrefixPrinter
+}
+
+func newPtermLogger(opts Options, progress bool) *ptermLogger {
+	return &ptermLogger{
+		opts:     opts,
+		progress: progress,
+		debug:    pterm.Debug.WithDebugger(false).WithWriter(opts.Writer),
+		info:     pterm.Info.WithWriter(opts.Writer),
+		success:  pterm.Success.WithWriter(opts.Writer),
+		warning:  pterm.Warning.WithWriter(opts.Writer),
+		error:    pterm.Error.WithWriter(opts.Writer),
+	}
+}
+
+func (l *ptermLogger) Debug(a ...interface{}) {
+	if l.opts.Debug {
+		l.debug.Println(a...)
+	}
+}
+
+func (l *ptermLogger) Info(a ...interface{}) {
+	if !l.opts.Quiet {
+		l.info.Println(a...)
+	}
+}
+
+func (l *ptermLogger) Success(a ...interface{}) {
+	if !l.opts.Quiet {
+		l.success.Println(a...)
+	}
+}
+
+func (l *ptermLogger) Warning(a ...interface{}) {
+	l.warning.Println(a...)
+}
+
+func (l *ptermLogger) Error(a ...interface{}) {
+	l.error.Println(a...)
+}
+
+func (l *ptermLogger) Progress(title string, total int) Progress {
+	if l.progress {
+		return startProgressbar(l.opts.Writer, title, total)
+	}
+	return noProgress{}
+}
+
+func (l *ptermLogger) DebugWriter() io.Writer {
+	if l.opts.Debug {
+		return l.opts.Writer
+	}
+	return nil
+}
+
+// progressbar is a pterm progress bar
+type progressbar struct {
+	bar *pterm.ProgressbarPrinter
+}
+
+func startProgressbar(w io.Writer, title string, total int) Progress {
+	bar, err := pterm.DefaultProgressbar.WithTotal(total).WithTitle(title).WithWriter(w).Start()
+	if err != nil {
+		return noProgress{}
+	}
+	return &progressbar{bar: bar}
+}
+
+func (p *progressbar) UpdateTitle(title string) {
+	p.bar.UpdateTitle(title)
+}
+
+func (p *progressbar) Increment() {
+	p.bar.Increment()
+}
+
+func (p *progressbar) Grow(n int) {
+	p.bar.Total += n
+}
+
+func (p *progressbar) Stop() {
+	p.bar.Stop()
+}
@@ -0,0 +1,273 @@
+package manager
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/k1nky/apm/internal/copy"
+	"gopkg.in/yaml.v3"
+)
+
+// BundleManifest is the first file of a bundle, it describes the packed entries
+const BundleManifest = "bundle.yml"
+
+// BundleVersion is a version of the bundle format
+const BundleVersion = 1
+
+// Manifest describes content of a bundle
+type Manifest struct {
+	Version int `yaml:"version"`
+	// Entries are index entries of the packed objects
+	Entries []*Entry `yaml:"entries"`
+	// Packages are the resolved mappings the bundle is made for
+	Packages []*Result `yaml:"packages"`
+}
+
+// Bundle writes the installed packages with their dependencies to `w` as a gzipped tar archive.
+// The archive contains the manifest and the objects of the packages, so the packages can be installed
+// without network after Storage.Import. All packages must be installed.
+func (m *Manager) Bundle(pkgs []*Package, w io.Writer) (results []*Result, err error) {
+	manifest := &Manifest{Version: BundleVersion}
+	keys := make(map[string]bool)
+	errs := make([]string, 0)
+
+	nodes := m.resolve(pkgs, func(n *Node) ([]*Package, error) {
+		p := n.Package
+		key, err := m.destKey(p.destPath(m.WorkDir))
+		if err != nil {
+			return nil, fmt.Errorf("%s is not installed", p.Dest)
+		}
+		e, err := m.Storage.Entry(key)
+		if err != nil || !m.Storage.HasObject(e) {
+			return nil, fmt.Errorf("%s is not found in the storage, install it again", p.Dest)
+		}
+		p.Version, n.Entry = e.Ref, e
+		mf, err := m.readManifest(p, m.Storage.ObjectPath(e))
+		if err != nil {
+			return nil, err
+		}
+		return mf.deps, nil
+	})
+	Walk(nodes, func(n *Node, depth int) {
+		switch {
+		case n.Err != nil:
+			errs = append(errs, n.Err.Error())
+		case n.Duplicate == nil:
+			r := m.Result(n)
+			r.StoragePath = ""
+			manifest.Packages = append(manifest.Packages, r)
+			key := n.Entry.key(n.Entry.Ref)
+			if keys[key] {
+				break
+			}
+			keys[key] = true
+			manifest.Entries = append(manifest.Entries, n.Entry)
+		}
+	})
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("%s", strings.Join(errs, ", "))
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	data, err := yaml.Marshal(manifest)
+	if err != nil {
+		return
+	}
+	if err = tw.WriteHeader(&tar.Header{Name: BundleManifest, Mode: 0644, Size: int64(len(data)), Typeflag: tar.TypeReg}); err != nil {
+		return
+	}
+	if _, err = tw.Write(data); err != nil {
+		return
+	}
+	packed := make(map[string]bool)
+	for _, e := range manifest.Entries {
+		object := path.Join(ObjectsDir, e.Tree, e.Name)
+		if packed[object] {
+			continue
+		}
+		packed[object] = true
+		if err = tarObject(tw, m.Storage.Root, object); err != nil {
+			return
+		}
+	}
+	if err = tw.Close(); err != nil {
+		return
+	}
+	return manifest.Packages, gz.Close()
+}
+
+// tarObject writes the object `name` relative to `root` into the archive, .git directories are skipped
+func tarObject(tw *tar.Writer, root string, name string) error {
+	return filepath.Walk(path.Join(root, name), func(file string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && info.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(file); err != nil {
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(root, file)
+		header.Name = filepath.ToSlash(rel)
+		if err = tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+}
+
+// Import places the objects of the bundle read from `r` into the storage and indexes their entries.
+// Content of the objects is verified with checksums of the entries.
+func (s *Storage) Import(r io.Reader) (manifest *Manifest, err error) {
+	var (
+		stage  string
+		header *tar.Header
+		data   []byte
+	)
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return
+	}
+	tr := tar.NewReader(gz)
+	if header, err = tr.Next(); err != nil {
+		return
+	}
+	if header.Name != BundleManifest {
+		return nil, fmt.Errorf("%s is expected first within the bundle", BundleManifest)
+	}
+	if data, err = ioutil.ReadAll(tr); err != nil {
+		return
+	}
+	manifest = &Manifest{}
+	if err = yaml.Unmarshal(data, manifest); err != nil {
+		return
+	}
+	if manifest.Version != BundleVersion {
+		return nil, fmt.Errorf("unsupported bundle version %d", manifest.Version)
+	}
+
+	if stage, err = ioutil.TempDir(s.Root, StagePrefix); err != nil {
+		return
+	}
+	defer os.RemoveAll(stage)
+	if err = untar(tr, stage); err != nil {
+		return
+	}
+
+	tx := &transaction{}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			tx.Commit()
+		}
+	}()
+	for _, e := range manifest.Entries {
+		staged := &Storage{Root: stage}
+		if !staged.HasObject(e) {
+			return nil, fmt.Errorf("the object of %s is missing within the bundle", Package{URL: e.URL, Version: e.Ref, Src: e.Src})
+		}
+		if e.Checksum != "" {
+			if sum, err := Checksum(staged.ObjectPath(e)); err != nil || sum != e.Checksum {
+				return nil, fmt.Errorf("the object of %s is corrupted", Package{URL: e.URL, Version: e.Ref, Src: e.Src})
+			}
+		}
+		if !s.HasObject(e) {
+			if e.Name != "" {
+				if err = os.MkdirAll(path.Join(s.Root, ObjectsDir, e.Tree), copy.Mode0755); err != nil {
+					return
+				}
+			}
+			if err = moveObject(staged.ObjectPath(e), s.ObjectPath(e)); err != nil {
+				return
+			}
+		}
+		if err = s.index(e, e.Ref, tx); err != nil {
+			return
+		}
+		if e.Ref != e.Commit {
+			if err = s.index(e, e.Commit, tx); err != nil {
+				return
+			}
+		}
+	}
+	return manifest, nil
+}
+
+// untar extracts objects of the archive into `dir`. Files are never written outside of `dir`,
+// including through symlinks from the archive.
+func untar(tr *tar.Reader, dir string) error {
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		name := path.Clean(header.Name)
+		if !strings.HasPrefix(name, ObjectsDir+"/") || strings.HasPrefix(name, "../") {
+			return fmt.Errorf("unexpected file %s within the bundle", header.Name)
+		}
+		target := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(target), copy.Mode0755); err != nil {
+			return err
+		}
+		parent, err := filepath.EvalSymlinks(filepath.Dir(target))
+		if err != nil {
+			return err
+		}
+		if root, _ := filepath.EvalSymlinks(dir); parent != root && !strings.HasPrefix(parent, root+string(filepath.Separator)) {
+			return fmt.Errorf("%s is placed outside of the bundle", header.Name)
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, copy.Mode0755)
+		case tar.TypeSymlink:
+			err = os.Symlink(header.Linkname, target)
+		case tar.TypeReg:
+			err = writeFile(target, tr, os.FileMode(header.Mode).Perm())
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func writeFile(name string, r io.Reader, mode os.FileMode) error {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
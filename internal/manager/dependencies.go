@@ -0,0 +1,237 @@
+package manager
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/k1nky/apm/internal/parser"
+)
+
+const (
+	// DependencyFile declares dependencies of a package in the requirements format
+	DependencyFile = "apm.yml"
+	// RoleMetaFile declares dependencies of an Ansible role, it is used when DependencyFile is missing
+	RoleMetaFile = "meta/main.yml"
+)
+
+// Node is a package within a dependency tree
+type Node struct {
+	// Package is installed with a resolved version
+	Package *Package
+	// Required is a version or a range of versions of the package required by the parent
+	Required string
+	Parent   *Node
+	Children []*Node
+	// Duplicate is the node which provides the destination of the package, when it is required several times
+	Duplicate *Node
+	// Err is set when the package can not be installed or its dependencies can not be read
+	Err error
+	// Entry is the installed content of the package
+	Entry    *Entry
+	UpToDate bool
+	// manifest is read from the content once, it is used to install the package
+	manifest *manifest
+}
+
+// manifest is what the package content declares within DependencyFile or RoleMetaFile
+type manifest struct {
+	deps []*Package
+	// hooks are declared within DependencyFile
+	hooks *Hooks
+}
+
+// Path returns the chain of packages from the root to the node
+func (n *Node) Path() string {
+	chain := make([]string, 0)
+	for p := n; p != nil; p = p.Parent {
+		chain = append([]string{p.Package.String()}, chain...)
+	}
+	return strings.Join(chain, " -> ")
+}
+
+// Conflicts reports whether the package is resolved by another package or by an unsatisfying version.
+// The version of the duplicate is compared only when it is resolved, e.g. a range of a package
+// which is not installed is not compared.
+func (n *Node) Conflicts() bool {
+	if n.Duplicate == nil {
+		return false
+	}
+	if !sameSource(n.Package, n.Duplicate.Package) {
+		return true
+	}
+	version := n.Duplicate.Package.Version
+	return !IsConstraint(version) && !Satisfies(version, n.Required)
+}
+
+func newNode(p *Package, parent *Node) *Node {
+	pkg := *p
+	if pkg.Version == "" {
+		pkg.Version = DefaultVersion
+	}
+	return &Node{Package: &pkg, Required: pkg.Version, Parent: parent}
+}
+
+// Walk calls `f` for the nodes in depth-first order with their depth
+func Walk(nodes []*Node, f func(n *Node, depth int)) {
+	var walk func(nodes []*Node, depth int)
+
+	walk = func(nodes []*Node, depth int) {
+		for _, n := range nodes {
+			f(n, depth)
+			walk(n.Children, depth+1)
+		}
+	}
+	walk(nodes, 0)
+}
+
+// sameSource reports whether the packages refer to the same content regardless of their versions
+func sameSource(a *Package, b *Package) bool {
+	return a.URL == b.URL && path.Clean(a.Src) == path.Clean(b.Src)
+}
+
+// resolve builds dependency trees of `roots` in breadth-first order. The packages are copied, so `expand`
+// can change their versions. `expand` installs or checks a package
+// and returns its dependencies. When a destination is required several times, the package nearest to the roots
+// wins and the others refer to it as duplicates. A package which depends on itself is reported as a cycle.
+func (m *Manager) resolve(roots []*Package, expand func(n *Node) ([]*Package, error)) []*Node {
+	nodes := make([]*Node, 0, len(roots))
+	for _, p := range roots {
+		nodes = append(nodes, newNode(p, nil))
+	}
+	queue := append([]*Node{}, nodes...)
+	dests := make(map[string]*Node)
+
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		for parent := n.Parent; parent != nil; parent = parent.Parent {
+			if sameSource(parent.Package, n.Package) {
+				n.Err = fmt.Errorf("dependency cycle %s", n.Path())
+				break
+			}
+		}
+		if n.Err != nil {
+			continue
+		}
+		if err := n.Package.Validate(); err != nil {
+			n.Err = err
+			continue
+		}
+		dest := path.Clean(n.Package.Dest)
+		if d, ok := dests[dest]; ok {
+			n.Duplicate = d
+			continue
+		}
+		dests[dest] = n
+		deps, err := expand(n)
+		if err != nil {
+			n.Err = err
+			continue
+		}
+		for _, dep := range deps {
+			child := newNode(dep, n)
+			n.Children = append(n.Children, child)
+			queue = append(queue, child)
+		}
+	}
+	return nodes
+}
+
+// Dependencies reads dependencies of the package installed into the working directory, LinksDir is used
+// when the destination does not exist.
+func (m *Manager) Dependencies(p *Package) ([]*Package, error) {
+	dir := p.destPath(m.WorkDir)
+	if _, err := os.Lstat(dir); os.IsNotExist(err) {
+		// the package is installed without the destination link
+		dir = p.linkPath(m.WorkDir)
+	}
+	mf, err := m.readManifest(p, dir)
+	if err != nil {
+		return nil, err
+	}
+	return mf.deps, nil
+}
+
+// readManifest reads dependencies and hooks of the package which content is placed into `dir`.
+// DependencyFile is looked up first, then RoleMetaFile. Role dependencies are placed next to the package.
+// A single file package declares nothing.
+func (m *Manager) readManifest(p *Package, dir string) (*manifest, error) {
+	var packages []parser.RequiredPackage
+
+	mf := &manifest{}
+	if info, err := os.Stat(dir); err != nil {
+		return nil, err
+	} else if !info.IsDir() {
+		return mf, nil
+	}
+
+	if f, err := os.Open(path.Join(dir, DependencyFile)); err == nil {
+		defer f.Close()
+		// includes and patches of dependencies are located within the package
+		req := &parser.Requirements{Filename: path.Join(dir, DependencyFile), BaseDir: dir, Fetch: m.fetchFile}
+		if err := req.Read(f); err != nil {
+			return nil, err
+		}
+		packages, mf.hooks = req.AllPackages(), NewHooks(req.Hooks, true)
+	} else if f, err := os.Open(path.Join(dir, RoleMetaFile)); err == nil {
+		var skipped []string
+		defer f.Close()
+		packages, skipped, err = parser.ReadRoleDependencies(f, path.Join(p.Dest, RoleMetaFile), path.Dir(p.Dest))
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range skipped {
+			m.Logger.Debug("skip dependency: " + s)
+		}
+	}
+
+	for _, pkg := range packages {
+		for _, mapping := range pkg.Mappings {
+			mf.deps = append(mf.deps, &Package{
+				URL:      pkg.Url,
+				Version:  mapping.Version,
+				Src:      mapping.Src,
+				Dest:     mapping.Dest,
+				Hooks:    NewHooks(mapping.Hooks, true),
+				Template: NewTemplate(mapping.Template),
+				Patches:  mapping.Patches,
+			})
+		}
+	}
+	return mf, nil
+}
+
+// fetchFile reads the file `p` from the repository `url` at `version` for remote includes of dependencies
+func (m *Manager) fetchFile(url string, version string, p string) ([]byte, error) {
+	dir, err := ioutil.TempDir("", DefaultTmpPrefix)
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	if err := m.Downloader.Get(url, version, dir, nil); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(p)))
+}
+
+// Tree returns dependency trees of the packages installed into the working directory. Versions of the packages
+// are taken from the storage entries of their destinations, the required ones are kept when the entries are missing.
+func (m *Manager) Tree(pkgs []*Package) []*Node {
+	return m.resolve(pkgs, func(n *Node) ([]*Package, error) {
+		p := n.Package
+		if _, err := os.Lstat(p.destPath(m.WorkDir)); err != nil {
+			return nil, fmt.Errorf("%s is not installed", p.Dest)
+		}
+		if key, err := m.destKey(p.destPath(m.WorkDir)); err == nil {
+			if e, err := m.Storage.Entry(key); err == nil {
+				p.Version, n.Entry = e.Ref, e
+			}
+		}
+		return m.Dependencies(p)
+	})
+}
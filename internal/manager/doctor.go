@@ -0,0 +1,290 @@
+package manager
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/k1nky/apm/internal/flock"
+)
+
+// DefaultStaleAge is the age after which temporary files are considered left by crashed runs
+const DefaultStaleAge = time.Hour
+
+// BackupSuffix is appended to destinations which are moved aside to be replaced by links
+const BackupSuffix = ".apm-backup"
+
+// ProblemKind is a kind of problem found by Doctor
+type ProblemKind string
+
+const (
+	// ProblemDanglingLink means a link within LinksDir points to a missing storage object,
+	// e.g. after the storage has been wiped
+	ProblemDanglingLink ProblemKind = "dangling-link"
+	// ProblemNotLink means the destination is a regular directory or file, so it can not be replaced by a link
+	ProblemNotLink ProblemKind = "not-a-link"
+	// ProblemOrphanedLink means a link within LinksDir is not used by any destination, e.g. a link to
+	// a previous version of a package. Status reports such links as orphaned as well.
+	ProblemOrphanedLink ProblemKind = "orphaned-link"
+	// ProblemStaleTemp means a temporary file or directory is left by a crashed run
+	ProblemStaleTemp ProblemKind = "stale-temp"
+)
+
+// Problem is a broken part of an installation
+type Problem struct {
+	Kind ProblemKind `json:"kind" yaml:"kind"`
+	Path string      `json:"path" yaml:"path"`
+	// Detail explains the problem
+	Detail string `json:"detail" yaml:"detail"`
+	// Fix describes the repair which is made or would be made with DoctorOptions.Fix
+	Fix   string `json:"fix" yaml:"fix"`
+	Fixed bool   `json:"fixed" yaml:"fixed"`
+	Error string `json:"error,omitempty" yaml:"error,omitempty"`
+
+	// reinstall is a package which is installed again to repair the problem
+	reinstall *Package
+	repair    func() error
+}
+
+type DoctorOptions struct {
+	// Fix repairs the problems
+	Fix bool
+	// StaleAge is DefaultStaleAge by default
+	StaleAge time.Duration
+	// Install is used to reinstall packages
+	Install *InstallOptions
+}
+
+// Doctor finds problems of the installation of the packages within the working directory and the storage.
+// With DoctorOptions.Fix the problems are repaired: dangling and orphaned links and stale temporary files are removed,
+// destinations which are not links are moved aside with BackupSuffix and the affected packages are reinstalled.
+func (m *Manager) Doctor(pkgs []*Package, opts *DoctorOptions) (problems []*Problem, err error) {
+	if opts == nil {
+		opts = &DoctorOptions{}
+	}
+	if opts.StaleAge == 0 {
+		opts.StaleAge = DefaultStaleAge
+	}
+
+	lock, err := flock.Acquire(path.Join(m.WorkDir, LinksDir, LockFile))
+	if err != nil {
+		return
+	}
+	if problems, err = m.diagnose(pkgs, opts.StaleAge); err != nil || !opts.Fix {
+		lock.Release()
+		return
+	}
+	reinstall := make([]*Package, 0)
+	for _, p := range problems {
+		if p.repair != nil {
+			if err := p.repair(); err != nil {
+				p.Error = err.Error()
+				continue
+			}
+		}
+		if p.reinstall == nil {
+			p.Fixed = true
+			continue
+		}
+		reinstall = append(reinstall, p.reinstall)
+	}
+	// Install acquires the lock by itself
+	lock.Release()
+	if len(reinstall) == 0 {
+		return
+	}
+
+	results, err := m.Install(reinstall, opts.Install)
+	if err != nil {
+		return
+	}
+	failed := make(map[string]string)
+	for _, r := range results {
+		if r.Status == StatusFailed {
+			failed[path.Clean(r.Dest)] = r.Error
+		}
+	}
+	for _, p := range problems {
+		if p.reinstall == nil || p.Error != "" {
+			continue
+		}
+		if e, ok := failed[path.Clean(p.reinstall.Dest)]; ok {
+			p.Error = e
+		} else {
+			p.Fixed = true
+		}
+	}
+	return
+}
+
+// diagnose finds the problems and prepares their repairs
+func (m *Manager) diagnose(pkgs []*Package, staleAge time.Duration) ([]*Problem, error) {
+	problems := make([]*Problem, 0)
+	links, err := m.destLinks()
+	if err != nil {
+		return nil, err
+	}
+	// reinstalled are the packages which are installed again, each one once
+	reinstalled := make(map[string]bool)
+	reinstall := func(p *Package) *Package {
+		dest := m.relDest(p)
+		if reinstalled[dest] {
+			return nil
+		}
+		reinstalled[dest] = true
+		return p
+	}
+
+	used := make(map[string]bool)
+	for _, key := range links {
+		used[key] = true
+	}
+	dir := path.Join(m.WorkDir, LinksDir)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		name := path.Join(dir, entry.Name())
+		if entry.Type()&os.ModeSymlink == 0 {
+			continue
+		}
+		key := entry.Name()
+		if _, err := os.Stat(name); err == nil {
+			if !used[key] {
+				problems = append(problems, &Problem{
+					Kind:   ProblemOrphanedLink,
+					Path:   path.Join(LinksDir, key),
+					Detail: "the link is not used by any destination",
+					Fix:    "remove the link",
+					repair: func() error {
+						return os.Remove(name)
+					},
+				})
+			}
+			continue
+		}
+		target, _ := os.Readlink(name)
+		problem := &Problem{
+			Kind:   ProblemDanglingLink,
+			Path:   path.Join(LinksDir, key),
+			Detail: fmt.Sprintf("the storage object %s does not exist", target),
+			Fix:    "remove the link",
+			repair: func() error {
+				return os.Remove(name)
+			},
+		}
+		for _, p := range pkgs {
+			if links[m.relDest(p)] == key {
+				if problem.reinstall = reinstall(p); problem.reinstall != nil {
+					problem.Fix = fmt.Sprintf("remove the link and reinstall %s", p.Dest)
+					break
+				}
+			}
+		}
+		problems = append(problems, problem)
+	}
+
+	for _, p := range pkgs {
+		dest := p.destPath(m.WorkDir)
+		info, err := os.Lstat(dest)
+		if err != nil || info.Mode()&os.ModeSymlink != 0 {
+			continue
+		}
+		if _, ok := links[m.relDest(p)]; ok {
+			// a rendered copy
+			continue
+		}
+		backup, err := backupPath(dest)
+		if err != nil {
+			return nil, err
+		}
+		kind := "file"
+		if info.IsDir() {
+			kind = "directory"
+		}
+		problems = append(problems, &Problem{
+			Kind:      ProblemNotLink,
+			Path:      p.Dest,
+			Detail:    fmt.Sprintf("the destination is a regular %s, so it can not be replaced by a link", kind),
+			Fix:       fmt.Sprintf("move it to %s and reinstall", path.Base(backup)),
+			reinstall: reinstall(p),
+			repair: func() error {
+				return os.Rename(dest, backup)
+			},
+		})
+	}
+
+	temps, err := m.staleTemps(pkgs, staleAge)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range temps {
+		name := name
+		problems = append(problems, &Problem{
+			Kind:   ProblemStaleTemp,
+			Path:   name,
+			Detail: fmt.Sprintf("the temporary file is older than %s", staleAge),
+			Fix:    "remove it",
+			repair: func() error {
+				return os.RemoveAll(name)
+			},
+		})
+	}
+	return problems, nil
+}
+
+// staleTemps returns temporary files older than `age` which are left by crashed runs within the storage, LinksDir,
+// parents of the destinations and clones within the system temporary directory. Temporary files are used
+// by running installations, so the age keeps them.
+func (m *Manager) staleTemps(pkgs []*Package, age time.Duration) ([]string, error) {
+	dirs := map[string]string{
+		m.Storage.Root:                        StagePrefix,
+		path.Join(m.Storage.Root, IndexDir):   StagePrefix,
+		path.Join(m.Storage.Root, ObjectsDir): StagePrefix,
+		path.Join(m.WorkDir, LinksDir):        StagePrefix,
+		filepath.Clean(os.TempDir()):          DefaultTmpPrefix,
+	}
+	for _, p := range pkgs {
+		dirs[path.Dir(p.destPath(m.WorkDir))] = StagePrefix
+	}
+
+	temps := make([]string, 0)
+	for dir, prefix := range dirs {
+		entries, err := os.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if !strings.HasPrefix(entry.Name(), prefix) {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil || time.Since(info.ModTime()) < age {
+				continue
+			}
+			temps = append(temps, filepath.Join(dir, entry.Name()))
+		}
+	}
+	sort.Strings(temps)
+	return temps, nil
+}
+
+// backupPath returns a path next to `name` which does not exist yet
+func backupPath(name string) (string, error) {
+	backup := name + BackupSuffix
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(backup); os.IsNotExist(err) {
+			return backup, nil
+		} else if err != nil {
+			return "", err
+		}
+		backup = fmt.Sprintf("%s%s-%d", name, BackupSuffix, i)
+	}
+}
@@ -0,0 +1,148 @@
+package manager
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/k1nky/apm/internal/parser"
+)
+
+// DefaultHookTimeout limits a run of a hook when no other timeout is given
+const DefaultHookTimeout = 5 * time.Minute
+
+// Hook stages
+const (
+	PreInstall  = "pre_install"
+	PostInstall = "post_install"
+	PreRemove   = "pre_remove"
+)
+
+// Hooks are shell commands run around changes of the destination. A package with hooks is installed as a copy
+// and hooks are run within the copy, so the shared content within the storage is never changed.
+// They get the environment variables APM_HOOK, APM_URL, APM_VERSION, APM_DEST, APM_STORAGE_PATH and APM_WORKDIR,
+// APM_STORAGE_PATH is the package content within the storage which must be treated as read-only.
+type Hooks struct {
+	PreInstall  string
+	PostInstall string
+	PreRemove   string
+	// Provided means the hooks are declared by a package rather than the root requirements,
+	// such hooks are run only when they are allowed
+	Provided bool
+}
+
+// HookOptions control runs of hooks
+type HookOptions struct {
+	// AllowProvided runs hooks declared by packages, otherwise they are skipped with a warning
+	AllowProvided bool
+	// Timeout is DefaultHookTimeout by default
+	Timeout time.Duration
+}
+
+// NewHooks converts hooks of requirements, nil is returned when there are no hooks
+func NewHooks(h *parser.Hooks, provided bool) *Hooks {
+	if h == nil || (h.PreInstall == "" && h.PostInstall == "" && h.PreRemove == "") {
+		return nil
+	}
+	return &Hooks{PreInstall: h.PreInstall, PostInstall: h.PostInstall, PreRemove: h.PreRemove, Provided: provided}
+}
+
+// command returns the command of the stage
+func (h *Hooks) command(stage string) string {
+	switch stage {
+	case PreInstall:
+		return h.PreInstall
+	case PostInstall:
+		return h.PostInstall
+	case PreRemove:
+		return h.PreRemove
+	}
+	return ""
+}
+
+// digest returns a digest of the commands
+func (h *Hooks) digest() string {
+	if h == nil {
+		return ""
+	}
+	return fmt.Sprintf("%q\n%q\n%q\n", h.PreInstall, h.PostInstall, h.PreRemove)
+}
+
+// runHooks runs the stage of hooks `own` declared by the package content `object` and then the hooks
+// of the package itself within `dir`. Provided hooks which are not allowed are skipped.
+func (m *Manager) runHooks(stage string, p *Package, own *Hooks, object string, dir string, opts *HookOptions) error {
+	if opts == nil {
+		opts = &HookOptions{}
+	}
+	for _, h := range []*Hooks{own, p.Hooks} {
+		if h == nil || h.command(stage) == "" {
+			continue
+		}
+		if h.Provided && !opts.AllowProvided {
+			m.Logger.Warning(fmt.Sprintf("%s hook of %s is declared by a package and skipped, it can be allowed with --allow-hooks", stage, p.Dest))
+			continue
+		}
+		if err := m.runHook(stage, h.command(stage), p, object, dir, opts.Timeout); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runHook runs `command` with `sh` within `dir`, a parent directory is used for a single file package. The command is killed along with its children after `timeout`.
+func (m *Manager) runHook(stage string, command string, p *Package, object string, dir string, timeout time.Duration) (err error) {
+	if timeout == 0 {
+		timeout = DefaultHookTimeout
+	}
+
+	m.Logger.Debug(fmt.Sprintf("run %s hook of %s: %s", stage, p.Dest, command))
+	output := &bytes.Buffer{}
+	cmd := hookCommand(command)
+	cmd.Dir = dir
+	if info, err := os.Stat(dir); err == nil && !info.IsDir() {
+		cmd.Dir = path.Dir(dir)
+	}
+	cmd.Stdout, cmd.Stderr = output, output
+	cmd.Env = append(os.Environ(),
+		"APM_HOOK="+stage,
+		"APM_URL="+p.URL,
+		"APM_VERSION="+p.Version,
+		"APM_DEST="+p.destPath(m.WorkDir),
+		"APM_STORAGE_PATH="+object,
+		"APM_WORKDIR="+m.WorkDir,
+	)
+	if err = cmd.Start(); err != nil {
+		return fmt.Errorf("%s hook of %s: %s", stage, p.Dest, err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	timedOut := false
+	select {
+	case err = <-done:
+	case <-timer.C:
+		timedOut = true
+		killHook(cmd)
+		err = <-done
+	}
+	if out := strings.TrimSpace(output.String()); out != "" {
+		m.Logger.Debug(out)
+	}
+	if timedOut {
+		return fmt.Errorf("%s hook of %s is timed out after %s", stage, p.Dest, timeout)
+	}
+	if err != nil {
+		// the last line of the output usually explains the failure
+		if lines := strings.Split(strings.TrimSpace(output.String()), "\n"); lines[len(lines)-1] != "" {
+			return fmt.Errorf("%s hook of %s: %s: %s", stage, p.Dest, err, lines[len(lines)-1])
+		}
+		return fmt.Errorf("%s hook of %s: %s", stage, p.Dest, err)
+	}
+	return nil
+}
@@ -0,0 +1,21 @@
+//go:build !windows
+// +build !windows
+
+package manager
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// hookCommand returns a shell command which is run within its own process group,
+// so it can be killed along with its children
+func hookCommand(command string) *exec.Cmd {
+	cmd := exec.Command("sh", "-e", "-c", command)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	return cmd
+}
+
+func killHook(cmd *exec.Cmd) {
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
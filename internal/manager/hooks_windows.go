@@ -0,0 +1,17 @@
+//go:build windows
+// +build windows
+
+package manager
+
+import (
+	"os/exec"
+)
+
+// hookCommand returns a shell command, `sh` is expected to be provided e.g. by Git for Windows
+func hookCommand(command string) *exec.Cmd {
+	return exec.Command("sh", "-e", "-c", command)
+}
+
+func killHook(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
@@ -0,0 +1,136 @@
+package manager
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// LockfileExt replaces the extension of the requirements file to name its lockfile, e.g. requirements.lock
+const LockfileExt = ".lock"
+
+// Lockfile keeps resolved versions and commits of installed mappings, so the same content is installed again
+type Lockfile struct {
+	Packages []*LockedPackage `yaml:"packages"`
+}
+
+// LockedPackage is an installed mapping
+type LockedPackage struct {
+	// Package is the package spec url@version#src with the resolved version
+	Package string `yaml:"package"`
+	Dest    string `yaml:"dest"`
+	Commit  string `yaml:"commit"`
+	// RequiredBy is a destination of the package which requires this one, it is empty for the root requirements
+	RequiredBy string `yaml:"required_by,omitempty"`
+}
+
+// LockfilePath returns a path of the lockfile next to the requirements file `filename`
+func LockfilePath(filename string) string {
+	return strings.TrimSuffix(filename, filepath.Ext(filename)) + LockfileExt
+}
+
+// ReadLockfile reads the lockfile `name`. An empty lockfile is returned if it does not exist.
+func ReadLockfile(name string) (*Lockfile, error) {
+	l := &Lockfile{}
+	data, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		return l, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(data, l); err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+	for _, lp := range l.Packages {
+		if _, err := ParsePackage(lp.Package); err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+	}
+	return l, nil
+}
+
+// WriteFile atomically writes the lockfile `name`
+func (l *Lockfile) WriteFile(name string) error {
+	data, err := yaml.Marshal(l)
+	if err != nil {
+		return err
+	}
+	tx := &transaction{}
+	if err := replaceFile(name, data, tx); err != nil {
+		return err
+	}
+	tx.Commit()
+	return nil
+}
+
+// Update locks the installed mappings of the results. Entries of failed mappings are kept, entries of other
+// destinations are kept when `keep` reports them, e.g. mappings which are not selected for the installation.
+func (l *Lockfile) Update(results []*Result, keep func(dest string) bool) {
+	packages := make([]*LockedPackage, 0, len(results))
+	installed := make(map[string]bool)
+	failed := make(map[string]bool)
+	for _, r := range results {
+		if r.Status == StatusFailed {
+			failed[path.Clean(r.Dest)] = true
+		}
+		if r.Commit == "" || (r.Status != StatusInstalled && r.Status != StatusUpToDate) {
+			continue
+		}
+		installed[path.Clean(r.Dest)] = true
+		packages = append(packages, &LockedPackage{
+			Package:    Package{URL: r.URL, Version: r.Version, Src: r.Src}.String(),
+			Dest:       r.Dest,
+			Commit:     r.Commit,
+			RequiredBy: r.RequiredBy,
+		})
+	}
+	for _, lp := range l.Packages {
+		dest := path.Clean(lp.Dest)
+		if !installed[dest] && (failed[dest] || keep != nil && keep(lp.Dest)) {
+			packages = append(packages, lp)
+		}
+	}
+	sort.SliceStable(packages, func(i, j int) bool {
+		return packages[i].Dest < packages[j].Dest
+	})
+	l.Packages = packages
+}
+
+// Lookup returns the locked mapping of the package destination which satisfies the required version of the package
+func (l *Lockfile) Lookup(p *Package) *Package {
+	if l == nil {
+		return nil
+	}
+	for _, lp := range l.Packages {
+		if path.Clean(lp.Dest) != path.Clean(p.Dest) {
+			continue
+		}
+		pkg, err := ParsePackage(lp.Package)
+		if err != nil || !sameSource(p, pkg) || !Satisfies(pkg.Version, p.Version) {
+			continue
+		}
+		pkg.Dest, pkg.Commit = lp.Dest, lp.Commit
+		return pkg
+	}
+	return nil
+}
+
+// versions returns the locked versions of packages by their sources
+func (l *Lockfile) versions() map[string][]string {
+	versions := make(map[string][]string)
+	if l == nil {
+		return versions
+	}
+	for _, lp := range l.Packages {
+		if pkg, err := ParsePackage(lp.Package); err == nil {
+			versions[sourceKey(pkg)] = append(versions[sourceKey(pkg)], pkg.Version)
+		}
+	}
+	return versions
+}
@@ -0,0 +1,6 @@
+package manager
+
+import "github.com/k1nky/apm/internal/logger"
+
+// Logger reports progress of the manager operations
+type Logger = logger.Logger
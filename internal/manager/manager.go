@@ -1,7 +1,7 @@
 package manager
 
 import (
-	"crypto/md5"
+	"crypto/sha256"
 	"fmt"
 	"io/fs"
 	"io/ioutil"
@@ -12,37 +12,162 @@ import (
 
 	"github.com/k1nky/apm/internal/copy"
 	"github.com/k1nky/apm/internal/downloader"
-
-	"github.com/pterm/pterm"
+	"github.com/k1nky/apm/internal/flock"
+	"github.com/k1nky/apm/internal/logger"
+	"github.com/k1nky/apm/internal/parser"
+	"github.com/k1nky/apm/internal/patch"
 )
 
+// Manager installs packages into a working directory. All operations are relative to the working directory
+// given on creation, so several managers can be used within one process.
 type Manager struct {
-	TmpDir  string
-	Storage string
+	Storage    *Storage
+	WorkDir    string
+	Downloader Downloader
+	Logger     Logger
+}
+
+// Options are used to create a manager
+type Options struct {
+	// StoragePath is a path to the storage, DefaultStoragePath is used by default
+	StoragePath string
+	// WorkDir is a working directory, the current directory is used by default
 	WorkDir string
+	// Storage can be shared between managers, StoragePath is ignored when it is set
+	Storage    *Storage
+	Downloader Downloader
+	Logger     Logger
+	// NoSetup leaves the working directory untouched, e.g. to fetch packages only
+	NoSetup bool
 }
+
+// Downloader fetches packages from remote repositories
+type Downloader interface {
+	Get(url string, version string, dest string, options *downloader.Options) error
+	Resolve(dir string, version string) (*downloader.Revision, error)
+	RemoteRevision(url string, version string, options *downloader.Options) (*downloader.Revision, error)
+	Tree(dir string, commit string, src string) (string, error)
+	FetchVersion(url string, options *downloader.Options) ([]string, error)
+}
+
 type InstallOptions struct {
-	WorkDir         string
 	DownloadOptions *downloader.Options
 	Force           bool
+	// NoDeps disables installation of dependencies declared by packages
+	NoDeps bool
+	// RewriteUrl is applied to urls of dependencies
+	RewriteUrl func(url string) string
+	// Overrides force versions of packages by their urls regardless of the requirements on them
+	Overrides map[string]string
+	// NoLink places packages into the storage and LinksDir without links at their destinations
+	NoLink bool
+	// Overwrite is asked whether an existing destination which is not a link can be moved aside
+	// with BackupSuffix to be replaced. Such destinations are kept when it is nil.
+	Overwrite func(dest string) bool
+	// FetchOnly places packages into the storage without changes of the working directory
+	FetchOnly bool
+	// Offline installs packages from the storage only, versions of branches are not checked
+	// and ranges of versions are resolved within the fetched versions
+	Offline bool
+	// Hooks control runs of hooks, they are run when a destination is linked to another content
+	Hooks HookOptions
+	// Lock pins packages to the versions and commits of the lockfile while they satisfy the requirements.
+	// Locked packages which are placed into the storage are installed without network.
+	Lock *Lockfile
+}
+
+// Status is an outcome of a package installation
+type Status string
+
+const (
+	StatusInstalled Status = "installed"
+	StatusUpToDate  Status = "up-to-date"
+	// StatusDuplicate means the destination is provided by another package
+	StatusDuplicate Status = "duplicate"
+	StatusFailed    Status = "failed"
+	StatusRemoved   Status = "removed"
+)
+
+// Result describes an installation of a package mapping
+type Result struct {
+	URL string `json:"url" yaml:"url"`
+	// Version is a resolved version of the package
+	Version string `json:"version" yaml:"version"`
+	// Required is a version or a range of versions required by the parent
+	Required string `json:"required" yaml:"required"`
+	// Commit is the resolved sha
+	Commit string `json:"commit,omitempty" yaml:"commit,omitempty"`
+	// StoragePath is a path to the package content within the storage
+	StoragePath string `json:"storage_path,omitempty" yaml:"storage_path,omitempty"`
+	Src         string `json:"src" yaml:"src"`
+	Dest        string `json:"dest" yaml:"dest"`
+	Status      Status `json:"status" yaml:"status"`
+	Error       string `json:"error,omitempty" yaml:"error,omitempty"`
+	// RequiredBy is a destination of the package which requires this one, it is empty for the root requirements
+	RequiredBy string `json:"required_by,omitempty" yaml:"required_by,omitempty"`
 }
+
 type Package struct {
 	URL     string
 	Version string
 	Src     string
 	Dest    string
+	// Commit pins the package to a resolved commit of a locked entry
+	Commit   string
+	Hooks    *Hooks
+	Template *Template
+	// Patches are paths to unified diff files which are applied to the package source in turn
+	Patches []string
 }
 
 const (
 	DefaultStoragePath = "~/.apm"
 	DefaultVersion     = "master"
 	DefaultTmpPrefix   = "apm-"
+	// LinksDir is a directory within a working directory which contains links to the storage
+	LinksDir = ".apm"
+	// LockFile is a name of the lock file within LinksDir
+	LockFile = ".lock"
 )
 
+// New returns a manager for the working directory. The storage and the working directory
+// are prepared if missing.
+func New(opts *Options) (m *Manager, err error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	m = &Manager{
+		Storage:    opts.Storage,
+		Downloader: opts.Downloader,
+		Logger:     opts.Logger,
+	}
+	if m.Storage == nil {
+		if m.Storage, err = NewStorage(opts.StoragePath); err != nil {
+			return nil, err
+		}
+	}
+	if m.Logger == nil {
+		m.Logger = logger.Default()
+	}
+	if m.Downloader == nil {
+		d := downloader.NewDownloader()
+		d.Logger = m.Logger
+		m.Downloader = d
+	}
+	if opts.NoSetup {
+		m.WorkDir, err = workdirPath(opts.WorkDir)
+	} else {
+		m.WorkDir, err = setupWorkdir(opts.WorkDir)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 func DefaultInstallOptions() *InstallOptions {
 	return &InstallOptions{
 		DownloadOptions: downloader.DefaultOptions(),
-		WorkDir:         ".",
 		Force:           false,
 	}
 }
@@ -54,12 +179,38 @@ func (opts *InstallOptions) Validate() error {
 	return nil
 }
 
+// Hash identifies the package within the working directory
 func (p Package) Hash() string {
-	return fmt.Sprintf("%x", md5.Sum([]byte(p.URL+p.Src+p.Version)))
+	return PatchedKey(p.URL, p.Src, p.Version, p.patchesDigest())
 }
 
+// patchesDigest returns a digest of the patches content, it is empty without patches.
+// A patch which can not be read changes the digest as well, so the package is not considered installed.
+func (p Package) patchesDigest() string {
+	if len(p.Patches) == 0 {
+		return ""
+	}
+	h := sha256.New()
+	for _, name := range p.Patches {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			fmt.Fprintf(h, "%s\x00", err)
+			continue
+		}
+		fmt.Fprintf(h, "%x\x00", sha256.Sum256(data))
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// String returns the package spec, see ParsePackage
 func (p Package) String() (s string) {
-	s = fmt.Sprintf("%s,%s,%s", p.URL, p.Version, p.Src)
+	s = p.URL
+	if p.Version != "" {
+		s += "@" + p.Version
+	}
+	if p.Src != "" && p.Src != "." {
+		s += "#" + p.Src
+	}
 	return
 }
 
@@ -73,152 +224,404 @@ func (p *Package) Validate() error {
 	if p.Src == "" {
 		p.Src = "."
 	}
+	if err := parser.ValidateSrc(p.Src); err != nil {
+		return fmt.Errorf("invalid package src: %s", err)
+	}
+	p.Src = path.Clean(p.Src)
 	if p.Dest == "" {
 		return fmt.Errorf("invalid package destination")
 	}
+	if err := parser.ValidateDest(p.Dest); err != nil {
+		return fmt.Errorf("invalid package destination: %s", err)
+	}
 	return nil
 }
 
-func PackageFromString(str string) *Package {
-	chunks := strings.Split(str, ",")
-	p := &Package{
-		URL: chunks[0],
+// ParsePackage parses the package spec `url[@version][#src]`, e.g. `github.com/k1nky/roles@v1.0#roles/common`.
+// Separators are looked up within the path of the url, so user names of ssh urls are kept.
+func ParsePackage(spec string) (*Package, error) {
+	p := &Package{}
+	start := urlPathIndex(spec)
+	rest := spec
+	if i := strings.Index(rest[start:], "#"); i >= 0 {
+		rest, p.Src = rest[:start+i], rest[start+i+1:]
+		if p.Src == "" {
+			return nil, fmt.Errorf("%s: empty src", spec)
+		}
 	}
-	if len(chunks) > 1 {
-		p.Version = chunks[1]
-		if len(chunks) > 2 {
-			p.Src = chunks[2]
+	if i := strings.Index(rest[start:], "@"); i >= 0 {
+		rest, p.Version = rest[:start+i], rest[start+i+1:]
+		if p.Version == "" {
+			return nil, fmt.Errorf("%s: empty version", spec)
 		}
 	}
-	return p
+	if p.URL = rest; p.URL == "" {
+		return nil, fmt.Errorf("%s: empty url", spec)
+	}
+	return p, nil
 }
 
-func (m *Manager) MakeStorage(dir string) (err error) {
-	if len(dir) == 0 {
-		dir = DefaultStoragePath
+// urlPathIndex returns the index of the path within `url`
+func urlPathIndex(url string) int {
+	if i := strings.Index(url, "://"); i >= 0 {
+		if j := strings.Index(url[i+3:], "/"); j >= 0 {
+			return i + 3 + j
+		}
+		return len(url)
 	}
-	if strings.HasPrefix(dir, "~/") {
-		home, _ := os.UserHomeDir()
-		dir = filepath.Join(home, dir[2:])
+	if downloader.IsSCPLike(url) {
+		return strings.Index(url, ":") + 1
 	}
-
-	m.Storage = dir
-	if err := os.MkdirAll(m.Storage, copy.Mode0755); err != nil && !os.IsExist(err) {
-		return err
-	}
-
-	return nil
+	return 0
 }
 
-func (m *Manager) cleanup() {
-	if m.TmpDir != "" {
-		os.RemoveAll(m.TmpDir)
-		m.TmpDir = ""
+// revision returns a version which should be checked out for the package
+func (p Package) revision() string {
+	if p.Commit != "" {
+		return p.Commit
 	}
+	return p.Version
 }
 
-func (m *Manager) download(p *Package, opts *downloader.Options) (err error) {
+// download clones the package into a new temporary directory which should be removed by the caller
+func (m *Manager) download(p *Package, opts *downloader.Options) (dir string, rev *downloader.Revision, err error) {
 
-	d := downloader.NewDownloader()
-	if m.TmpDir == "" {
-		if m.TmpDir, err = ioutil.TempDir("", DefaultTmpPrefix); err != nil {
-			return
-		}
+	if dir, err = ioutil.TempDir("", DefaultTmpPrefix); err != nil {
+		return
 	}
 
-	err = d.Get(p.URL, p.Version, m.TmpDir, opts)
+	if err = m.Downloader.Get(p.URL, p.revision(), dir, opts); err != nil {
+		return
+	}
+	if rev, err = m.Downloader.Resolve(dir, p.revision()); err != nil || p.Commit == "" {
+		return
+	}
+	// the locked commit is indexed by the version, so the type of the version is kept
+	// and an unlocked branch is compared with the remote repository again
+	if r, err := m.Downloader.Resolve(dir, p.Version); err == nil {
+		rev.Type = r.Type
+	}
 	return
 }
 
-// func (m *Manager) unpack(destDir string, src string) (err error) {
-func (m *Manager) unpack(src string, dest string) (err error) {
-	// copy to storage
-	tmpSrc := path.Join(m.TmpDir, src)
-	if info, err := os.Stat(tmpSrc); err != nil {
-		return err
-	} else {
-		if info.Mode().IsRegular() {
-			dest = path.Join(dest, src)
-		}
+// isUpToDate checks whether the storage already contains the required revision of the package
+// and returns its entry. Immutable revisions (tags, commits and locked entries) are checked without
+// network access, branches are compared with the remote repository.
+func (m *Manager) isUpToDate(p *Package, opts *downloader.Options, offline bool) (*Entry, bool) {
+	if p.Commit != "" {
+		return m.lockedEntry(p)
+	}
+	e, err := m.Storage.Entry(PatchedKey(p.URL, p.Src, p.Version, p.patchesDigest()))
+	if err != nil || !m.Storage.HasObject(e) {
+		return nil, false
+	}
+	switch {
+	case offline:
+		return e, true
+	case downloader.IsCommitHash(p.Version):
+		return e, e.Commit == p.Version
+	case e.Type == downloader.RefTag || e.Type == downloader.RefCommit:
+		return e, true
 	}
 
-	if err = copy.Copy(tmpSrc, dest, &copy.CopyOptions{
-		Override: true,
-		Plain:    src == "" || src == ".",
-	}); err != nil {
-		return
+	rev, err := m.Downloader.RemoteRevision(p.URL, p.Version, opts)
+	if err != nil {
+		m.Logger.Debug(err)
+		return e, false
 	}
+	return e, rev.Commit == e.Commit
+}
 
-	return
+// lockedEntry returns the entry of the locked commit of the package indexed by its version. A commit which
+// has been placed into the storage for another version is indexed by the version without network access.
+func (m *Manager) lockedEntry(p *Package) (*Entry, bool) {
+	if e, err := m.Storage.Entry(p.Hash()); err == nil && e.Commit == p.Commit && m.Storage.HasObject(e) {
+		return e, true
+	}
+	e, err := m.Storage.Entry(PatchedKey(p.URL, p.Src, p.Commit, p.patchesDigest()))
+	if err != nil || !m.Storage.HasObject(e) {
+		return nil, false
+	}
+	tx := &transaction{}
+	if err := m.Storage.index(e, p.Version, tx); err != nil {
+		m.Logger.Debug(err)
+		tx.Rollback()
+		return nil, false
+	}
+	tx.Commit()
+	e.Ref = p.Version
+	return e, true
 }
 
-func (m *Manager) SetupWorkdir(wd string) (err error) {
-	m.WorkDir = wd
-	if m.WorkDir == "" {
-		if m.WorkDir, err = os.Getwd(); err != nil {
+// workdirPath returns an absolute path of the working directory `wd`.
+// The current directory is used when `wd` is empty.
+func workdirPath(wd string) (string, error) {
+	if wd == "" {
+		wd = "."
+	}
+	return filepath.Abs(wd)
+}
+
+// setupWorkdir prepares the working directory `wd` and returns its absolute path.
+func setupWorkdir(wd string) (abs string, err error) {
+	if abs, err = workdirPath(wd); err != nil {
+		return
+	}
+
+	if err = os.MkdirAll(path.Join(abs, LinksDir), copy.Mode0755); err != nil {
+		if !os.IsExist(err) {
 			return
 		}
 	}
+	return abs, nil
+}
 
-	if err = os.MkdirAll(path.Join(m.WorkDir, ".apm"), copy.Mode0755); err != nil {
-		if !os.IsExist(err) {
+// makeLink points the symlink `name` to `target`. An existing symlink is replaced atomically
+// when `override` is set, the previous one is restored on rollback.
+func makeLink(name string, target string, override bool, tx *transaction) (err error) {
+	var (
+		info fs.FileInfo
+		prev string
+	)
+
+	restore := func() error {
+		return os.Remove(name)
+	}
+	if info, err = os.Lstat(name); err == nil {
+		if !override || info.Mode()&os.ModeSymlink == 0 {
+			return fmt.Errorf("file %s already exists", name)
+		}
+		if prev, err = os.Readlink(name); err != nil {
 			return
 		}
+		restore = func() error {
+			return replaceLink(name, prev)
+		}
 	}
-	if err = os.Chdir(m.WorkDir); err != nil {
+	if err = replaceLink(name, target); err != nil {
 		return
 	}
+	tx.onRollback(restore)
 	return
 }
 
-func makeLink(name string, target string, override bool) (err error) {
-	var info fs.FileInfo
+// moveAside renames `name` with BackupSuffix, it is renamed back on rollback
+func moveAside(name string, tx *transaction) error {
+	backup, err := backupPath(name)
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(name, backup); err != nil {
+		return err
+	}
+	tx.onRollback(func() error {
+		return os.Rename(backup, name)
+	})
+	return nil
+}
 
-	if info, err = os.Lstat(name); err == nil {
-		if !override || info.Mode()&os.ModeSymlink == 0 {
-			return fmt.Errorf("file %s already exists", name)
+// setup places the package downloaded to `dir` into the storage
+func (m *Manager) setup(pkg *Package, rev *downloader.Revision, dir string) (e *Entry, err error) {
+	tx := &transaction{}
+	defer func() {
+		if err != nil {
+			if rerr := tx.Rollback(); rerr != nil {
+				m.Logger.Error(rerr)
+			}
+		} else {
+			tx.Commit()
 		}
-		if err = os.Remove(name); err != nil {
+	}()
+
+	e = &Entry{
+		URL:    pkg.URL,
+		Src:    pkg.Src,
+		Ref:    pkg.Version,
+		Type:   rev.Type,
+		Commit: rev.Commit,
+	}
+	if e.Tree, err = m.Downloader.Tree(dir, rev.Commit, pkg.Src); err != nil {
+		return
+	}
+	if len(pkg.Patches) > 0 {
+		if err = applyPatches(pkg, path.Join(dir, pkg.Src)); err != nil {
 			return
 		}
-		err = nil
+		e.Patches = pkg.patchesDigest()
+		e.Tree = patchedTree(e.Tree, e.Patches)
 	}
-	err = os.Symlink(target, name)
+	err = m.Storage.Put(e, path.Join(dir, pkg.Src), tx)
 	return
 }
 
-func (m *Manager) setup(pkg *Package) (err error) {
+// applyPatches applies the patches of the package to its source `src` within the downloaded repository.
+// The patches of a single file package are applied within its directory.
+func applyPatches(pkg *Package, src string) error {
+	dir := src
+	if info, err := os.Stat(src); err != nil {
+		return err
+	} else if !info.IsDir() {
+		dir = path.Dir(src)
+	}
+	for _, name := range pkg.Patches {
+		if err := patch.ApplyFile(dir, name); err != nil {
+			return fmt.Errorf("patch %s can not be applied to %s: %s", name, pkg, err)
+		}
+	}
+	return nil
+}
+
+// destPath returns an absolute path of the package destination within the working directory `wd`
+func (p Package) destPath(wd string) string {
+	return path.Join(wd, p.Dest)
+}
+
+// linkPath returns a path of the link to the package content within LinksDir
+func (p Package) linkPath(wd string) string {
+	return path.Join(wd, LinksDir, p.Hash())
+}
+
+// link makes the storage entry of the package available within the working directory. The destination
+// is a link to LinksDir, or a copy when the package has a template or hooks, `own` are the hooks declared by the content.
+// `changed` reports whether the link within LinksDir or the destination is made again.
+func (m *Manager) link(pkg *Package, e *Entry, own *Hooks, opts *InstallOptions, tx *transaction) (changed bool, err error) {
 
 	var (
 		relpath string
+		info    fs.FileInfo
+		records map[string]*Rendered
 	)
 
-	pkgHash := pkg.Hash()
-	pkgStoragePath := path.Join(m.Storage, pkgHash)
-
-	if err = m.unpack(pkg.Src, pkgStoragePath); err != nil {
+	pkgLocalPath := pkg.linkPath(m.WorkDir)
+	if target, _ := os.Readlink(pkgLocalPath); target != m.Storage.ObjectPath(e) {
+		changed = true
+	}
+	if err = makeLink(pkgLocalPath, m.Storage.ObjectPath(e), true, tx); err != nil {
 		return
 	}
-	if err = makeLink(path.Join(".apm", pkgHash), path.Join(pkgStoragePath, pkg.Src), true); err != nil {
+	if opts.NoLink {
 		return
 	}
 
-	pkgLocalPath := path.Join(".apm", pkgHash)
+	if records, err = m.loadRendered(); err != nil {
+		return
+	}
+	// hooks are not run again while the destination refers to the same content
+	if !opts.Force && m.isInstalled(pkg, e, own, records) {
+		return
+	}
+	changed = true
+	if pkg.isCopy(own) {
+		err = m.copyDest(pkg, e, own, records, opts, tx)
+		return
+	}
 
-	relpath, _ = filepath.Rel(path.Dir(pkg.Dest), pkgLocalPath)
-	if err = os.MkdirAll(path.Dir(pkg.Dest), copy.Mode0755); err != nil {
+	dest := pkg.destPath(m.WorkDir)
+	if _, ok := records[m.relDest(pkg)]; ok {
+		// the package was copied before
+		if err = m.clearDest(pkg, records, opts, tx); err != nil {
+			return
+		}
+		if err = m.saveRendered(records, tx); err != nil {
+			return
+		}
+	}
+	if info, err = os.Lstat(dest); err == nil && info.Mode()&os.ModeSymlink == 0 && opts.Overwrite != nil && opts.Overwrite(dest) {
+		if err = moveAside(dest, tx); err != nil {
+			return
+		}
+	}
+	// the destination link is relative, so the working directory can be moved
+	relpath, _ = filepath.Rel(path.Dir(dest), pkgLocalPath)
+	if err = os.MkdirAll(path.Dir(dest), copy.Mode0755); err != nil {
 		return
 	}
-	if err = makeLink(pkg.Dest, relpath, true); err != nil {
+	err = makeLink(dest, relpath, true, tx)
+
+	return
+}
+
+// installPackage places the package into the storage unless it is up to date there.
+// The storage entry of the package is locked, so concurrent installations of the same package
+// download it once.
+func (m *Manager) installPackage(p *Package, opts *InstallOptions) (e *Entry, upToDate bool, err error) {
+	var (
+		lock *flock.Lock
+		dir  string
+		rev  *downloader.Revision
+	)
+
+	if lock, err = m.Storage.Lock(p.URL, p.Src, p.Version); err != nil {
 		return
 	}
+	defer lock.Release()
 
+	if e, ok := m.isUpToDate(p, opts.DownloadOptions, opts.Offline); ok && !opts.Force {
+		return e, true, nil
+	}
+
+	if opts.Offline {
+		return nil, false, fmt.Errorf("%s is not fetched, it can not be installed offline", p)
+	}
+	dir, rev, err = m.download(p, opts.DownloadOptions)
+	if dir != "" {
+		defer os.RemoveAll(dir)
+	}
+	if err != nil {
+		return
+	}
+	e, err = m.setup(p, rev, dir)
 	return
 }
 
-func (m *Manager) Install(pkgs []*Package, opts *InstallOptions) (err error) {
+// Result describes the installation of the node
+func (m *Manager) Result(n *Node) *Result {
+	p := n.Package
+	r := &Result{
+		URL:      p.URL,
+		Version:  p.Version,
+		Required: n.Required,
+		Src:      p.Src,
+		Dest:     p.Dest,
+	}
+	if n.Parent != nil {
+		r.RequiredBy = n.Parent.Package.Dest
+	}
+	switch {
+	case n.Err != nil:
+		r.Status, r.Error = StatusFailed, n.Err.Error()
+	case n.Duplicate != nil:
+		r.Status, r.Version = StatusDuplicate, n.Duplicate.Package.Version
+		if n.Conflicts() {
+			r.Error = fmt.Sprintf("%s is required by %s, but %s is installed into %s",
+				n.Package, n.Path(), n.Duplicate.Package, n.Package.Dest)
+		}
+	case n.UpToDate:
+		r.Status = StatusUpToDate
+	default:
+		r.Status = StatusInstalled
+	}
+	if n.Entry != nil {
+		r.Commit, r.StoragePath = n.Entry.Commit, m.Storage.ObjectPath(n.Entry)
+	}
+	return r
+}
 
-	defer m.cleanup()
+// Fetch places the packages with their dependencies into the storage without changes of the working directory,
+// so they can be installed later offline
+func (m *Manager) Fetch(pkgs []*Package, opts *InstallOptions) ([]*Result, error) {
+	if opts == nil {
+		opts = DefaultInstallOptions()
+	}
+	fetch := *opts
+	fetch.FetchOnly = true
+	return m.Install(pkgs, &fetch)
+}
+
+// Install installs the packages with their dependencies and returns results of every mapping.
+// Failures of separate packages are reported within the results.
+func (m *Manager) Install(pkgs []*Package, opts *InstallOptions) (results []*Result, err error) {
+	var lock *flock.Lock
 
 	if opts == nil {
 		opts = DefaultInstallOptions()
@@ -226,37 +629,279 @@ func (m *Manager) Install(pkgs []*Package, opts *InstallOptions) (err error) {
 		opts.Validate()
 	}
 
-	if err = m.MakeStorage(""); err != nil {
-		return
+	if !opts.FetchOnly {
+		if lock, err = flock.Acquire(path.Join(m.WorkDir, LinksDir, LockFile)); err != nil {
+			return
+		}
+		defer lock.Release()
 	}
 
-	if err = m.SetupWorkdir(opts.WorkDir); err != nil {
-		return
+	res := newResolver(opts.Overrides, func(url string) ([]string, error) {
+		if opts.Offline {
+			return m.Storage.Refs(url)
+		}
+		return m.Downloader.FetchVersion(url, opts.DownloadOptions)
+	})
+	res.locked = opts.Lock.versions()
+
+	progressBar := m.Logger.Progress("Installing", len(pkgs))
+	defer progressBar.Stop()
+
+	// packages are placed into the storage while versions are resolved, the working directory is changed
+	// and hooks are run only when the versions are settled
+	type fetched struct {
+		entry    *Entry
+		upToDate bool
 	}
+	entries := make(map[string]fetched)
+	// manifests are read once per package and destination, role dependencies are placed next to the destination
+	manifests := make(map[string]*manifest)
+	expand := func(n *Node) ([]*Package, error) {
+		p := n.Package
+		progressBar.UpdateTitle("Installing " + p.String())
+		defer progressBar.Increment()
+		// requirements of the package are recorded even when it fails, so the previous ones are not used
+		defer res.expand(p.Dest)
 
-	progressBar, _ := pterm.DefaultProgressbar.WithTotal(len(pkgs)).WithTitle("Installing").Start()
+		version, err := res.resolve(p, n.Parent == nil)
+		if err != nil {
+			return nil, err
+		}
+		p.Version = version
+		if locked := opts.Lock.Lookup(p); locked != nil && locked.Version == version {
+			p.Commit = locked.Commit
+		}
 
-	for _, p := range pkgs {
-		m.cleanup()
-		progressBar.UpdateTitle("Installing " + p.String())
+		f, ok := entries[p.Hash()]
+		if !ok {
+			if f.entry, f.upToDate, err = m.installPackage(p, opts); err != nil {
+				return nil, err
+			}
+			entries[p.Hash()] = f
+		}
+		n.Entry, n.UpToDate = f.entry, f.upToDate
+		// the manifest is read from the storage, since the destination may be not linked
+		key := p.Hash() + "\x00" + p.Dest
+		mf, ok := manifests[key]
+		if !ok {
+			if mf, err = m.readManifest(p, m.Storage.ObjectPath(f.entry)); err != nil {
+				return nil, fmt.Errorf("dependencies of %s: %s", p, err)
+			}
+			manifests[key] = mf
+		}
+		n.manifest = mf
+		if opts.NoDeps {
+			return nil, nil
+		}
+		// the dependencies are copied, since their urls are rewritten
+		deps := make([]*Package, 0, len(mf.deps))
+		for _, dep := range mf.deps {
+			dep := *dep
+			deps = append(deps, &dep)
+		}
+		for _, dep := range deps {
+			if opts.RewriteUrl != nil {
+				dep.URL = opts.RewriteUrl(dep.URL)
+			}
+			res.require(dep, p.Dest)
+		}
+		progressBar.Grow(len(deps))
+		return deps, nil
+	}
 
-		if err := p.Validate(); err != nil {
-			pterm.Warning.Println(err)
-			continue
+	// dependencies found later may require other versions of resolved packages,
+	// so they are resolved again until the versions are settled
+	var nodes []*Node
+	for pass := 1; ; pass++ {
+		res.pass()
+		nodes = m.resolve(pkgs, expand)
+		if !res.changed() {
+			break
+		}
+		if pass == maxResolvePasses {
+			m.Logger.Warning("versions of dependencies are not settled")
+			break
 		}
+		progressBar.Grow(len(pkgs))
+	}
+	if !opts.FetchOnly {
+		m.linkNodes(nodes, opts)
+		if err := m.pruneLinks(nodes); err != nil {
+			m.Logger.Warning(fmt.Sprintf("unused links are not removed: %s", err))
+		}
+	}
+	Walk(nodes, func(n *Node, depth int) {
+		if n.Err != nil || n.Duplicate != nil {
+			return
+		}
+		switch {
+		case n.UpToDate:
+			m.Logger.Success("Up to date " + n.Package.String())
+		case opts.FetchOnly:
+			m.Logger.Success("Fetched " + n.Package.String())
+		default:
+			m.Logger.Success("Installing " + n.Package.String())
+		}
+	})
+
+	Walk(nodes, func(n *Node, depth int) {
+		r := m.Result(n)
+		if r.Error != "" {
+			m.Logger.Warning(r.Error)
+		}
+		results = append(results, r)
+	})
+
+	return results, nil
+}
+
+// linkNodes links the resolved packages into the working directory. A failed package is rolled back
+// and the failure is recorded within its node. A node is not up to date when its links or destination are changed.
+func (m *Manager) linkNodes(nodes []*Node, opts *InstallOptions) {
+	Walk(nodes, func(n *Node, depth int) {
+		if n.Err != nil || n.Duplicate != nil || n.Entry == nil {
+			return
+		}
+		tx := &transaction{}
+		changed, err := m.link(n.Package, n.Entry, n.manifest.hooks, opts, tx)
+		if err != nil {
+			if rerr := tx.Rollback(); rerr != nil {
+				m.Logger.Error(rerr)
+			}
+			n.Err = err
+			return
+		}
+		tx.Commit()
+		if changed {
+			// the content is up to date within the storage, but the working directory is changed
+			n.UpToDate = false
+		}
+	})
+}
 
-		if err = m.download(p, opts.DownloadOptions); err != nil {
-			pterm.Warning.Println(err)
+// pruneLinks removes links within LinksDir which are used neither by destinations nor by the nodes,
+// e.g. links to previous versions of packages. Links of the nodes are kept, so packages placed with
+// InstallOptions.NoLink stay available.
+func (m *Manager) pruneLinks(nodes []*Node) error {
+	used := make(map[string]bool)
+	Walk(nodes, func(n *Node, depth int) {
+		used[n.Package.Hash()] = true
+	})
+	links, err := m.destLinks()
+	if err != nil {
+		return err
+	}
+	for _, key := range links {
+		used[key] = true
+	}
+	entries, err := os.ReadDir(path.Join(m.WorkDir, LinksDir))
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Type()&os.ModeSymlink == 0 || used[entry.Name()] {
 			continue
 		}
+		if err := os.Remove(path.Join(m.WorkDir, LinksDir, entry.Name())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		m.Logger.Debug("Removed unused link " + path.Join(LinksDir, entry.Name()))
+	}
+	return nil
+}
+
+// removeDest removes the destination, it returns the key of the link to the content.
+// A copy is removed unless it has been modified, pre_remove hooks are run within the copy before.
+func (m *Manager) removeDest(p *Package, records map[string]*Rendered, opts *RemoveOptions) (string, error) {
+	dest := p.destPath(m.WorkDir)
+	r, rendered := records[m.relDest(p)]
+	if !rendered {
+		// a package with hooks is installed as a copy, so there are no hooks to run
+		key, err := m.linkKey(dest)
+		if err != nil {
+			return "", err
+		}
+		return key, os.Remove(dest)
+	}
+
+	if sum, err := Checksum(dest); err != nil || sum != r.Checksum {
+		return "", fmt.Errorf("%s has been modified after installation, it is kept", p.Dest)
+	}
+	// the content declaring hooks is read through the link within LinksDir
+	object := path.Join(m.WorkDir, LinksDir, r.Key)
+	mf, err := m.readManifest(p, object)
+	if err != nil {
+		return "", fmt.Errorf("hooks of %s: %s", p.Dest, err)
+	}
+	if err := m.runHooks(PreRemove, p, mf.hooks, object, dest, &opts.Hooks); err != nil {
+		return "", err
+	}
+	if err := os.RemoveAll(dest); err != nil {
+		return "", err
+	}
+	delete(records, m.relDest(p))
+	tx := &transaction{}
+	if err := m.saveRendered(records, tx); err != nil {
+		return "", err
+	}
+	tx.Commit()
+	return r.Key, nil
+}
+
+// RemoveOptions are used to remove packages
+type RemoveOptions struct {
+	Hooks HookOptions
+}
+
+// Remove removes links at destinations of the packages. Links within LinksDir which are not used anymore
+// are removed as well, the content is kept within the storage. Destinations which are not links to LinksDir
+// are left as is and reported as failures. A failed pre_remove hook keeps the destination.
+func (m *Manager) Remove(pkgs []*Package, opts *RemoveOptions) (results []*Result, err error) {
+	var lock *flock.Lock
 
-		if err = m.setup(p); err != nil {
-			pterm.Warning.Println(err)
+	if opts == nil {
+		opts = &RemoveOptions{}
+	}
+
+	if lock, err = flock.Acquire(path.Join(m.WorkDir, LinksDir, LockFile)); err != nil {
+		return
+	}
+	defer lock.Release()
+
+	records, err := m.loadRendered()
+	if err != nil {
+		return
+	}
+	keys := make(map[string]bool)
+	for _, p := range pkgs {
+		r := &Result{URL: p.URL, Version: p.Version, Required: p.Version, Src: p.Src, Dest: p.Dest, Status: StatusRemoved}
+		results = append(results, r)
+		dest := p.destPath(m.WorkDir)
+		if _, err := os.Lstat(dest); os.IsNotExist(err) {
+			m.Logger.Debug(p.Dest + " is not installed")
 			continue
 		}
-		pterm.Success.Printfln("Installing " + p.String())
-		progressBar.Increment()
+		key, err := m.removeDest(p, records, opts)
+		if err != nil {
+			r.Status, r.Error = StatusFailed, err.Error()
+			m.Logger.Warning(fmt.Sprintf("%s: %s", p.Dest, err))
+			continue
+		}
+		keys[key] = true
+		m.Logger.Success("Removed " + p.Dest)
 	}
 
-	return nil
+	links, err := m.destLinks()
+	if err != nil {
+		return
+	}
+	for _, key := range links {
+		delete(keys, key)
+	}
+	for key := range keys {
+		if err = os.Remove(path.Join(m.WorkDir, LinksDir, key)); err != nil && !os.IsNotExist(err) {
+			return
+		}
+	}
+	return results, nil
 }
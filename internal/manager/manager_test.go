@@ -1,11 +1,24 @@
 package manager
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
 	"io/fs"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/k1nky/apm/internal/downloader"
 )
 
 func setUp() (tmpdir string, err error) {
@@ -14,18 +27,19 @@ func setUp() (tmpdir string, err error) {
 }
 
 func testInstallPackage(p *Package) (err error) {
-	m := Manager{}
+	var m *Manager
 	tmpDir := ""
 	if tmpDir, err = setUp(); err != nil {
 		return err
 	}
-	defer os.RemoveAll(m.WorkDir)
-	if err = m.Install([]*Package{p}, &InstallOptions{
-		WorkDir: tmpDir,
-	}); err != nil {
+	defer os.RemoveAll(tmpDir)
+	if m, err = New(&Options{WorkDir: tmpDir}); err != nil {
+		return
+	}
+	if _, err = m.Install([]*Package{p}, nil); err != nil {
 		return
 	}
-	err = filepath.Walk(m.WorkDir, func(path string, info fs.FileInfo, err error) error {
+	err = filepath.Walk(tmpDir, func(path string, info fs.FileInfo, err error) error {
 		if !strings.Contains(path, ".apm") {
 			if info.Mode()&os.ModeSymlink != 0 {
 				if _, err := filepath.EvalSymlinks(path); err != nil {
@@ -74,3 +88,1362 @@ func TestInstallSubfiles(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func commitTestFile(repo *git.Repository, dir string, name string, content string) (hash plumbing.Hash, err error) {
+	var wt *git.Worktree
+
+	if wt, err = repo.Worktree(); err != nil {
+		return
+	}
+	if err = os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755); err != nil {
+		return
+	}
+	if err = os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+		return
+	}
+	if _, err = wt.Add(name); err != nil {
+		return
+	}
+	return wt.Commit("update "+name, &git.CommitOptions{
+		Author: &object.Signature{Name: "apm", Email: "apm@localhost", When: time.Now()},
+	})
+}
+
+// setUpTestRepo creates a local repository with the tag v1.0 on the first commit
+func setUpTestRepo() (dir string, repo *git.Repository, err error) {
+	var hash plumbing.Hash
+
+	if dir, err = os.MkdirTemp("", "apm-repo"); err != nil {
+		return
+	}
+	if repo, err = git.PlainInit(dir, false); err != nil {
+		return
+	}
+	if hash, err = commitTestFile(repo, dir, "tasks/main.yml", "---\n"); err != nil {
+		return
+	}
+	_, err = repo.CreateTag("v1.0", hash, nil)
+	return
+}
+
+// newTestManager returns a manager with a temporary working directory and storage
+func newTestManager(t *testing.T) *Manager {
+	m, err := New(&Options{
+		WorkDir:     t.TempDir(),
+		StoragePath: t.TempDir(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestInstallUpToDate(t *testing.T) {
+	repoDir, repo, err := setUpTestRepo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(repoDir)
+	m := newTestManager(t)
+	branch := &Package{URL: repoDir, Version: "master", Src: "tasks", Dest: "roles/branch"}
+	tag := &Package{URL: repoDir, Version: "v1.0", Src: "tasks", Dest: "roles/tag"}
+	results, err := m.Install([]*Package{branch, tag}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range results {
+		if r.Status != StatusInstalled {
+			t.Fatalf("unexpected result %+v", r)
+		}
+	}
+	if _, ok := m.isUpToDate(branch, nil, false); !ok {
+		t.Fatal("installed branch is expected to be up to date")
+	}
+	if _, ok := m.isUpToDate(tag, nil, false); !ok {
+		t.Fatal("installed tag is expected to be up to date")
+	}
+	if _, err := commitTestFile(repo, repoDir, "tasks/main.yml", "--- # changed\n"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.isUpToDate(branch, nil, false); ok {
+		t.Error("branch is expected to be out of date after a new commit")
+	}
+	// tags are checked without network
+	os.RemoveAll(repoDir)
+	if _, ok := m.isUpToDate(tag, nil, false); !ok {
+		t.Error("tag is expected to be up to date without access to the remote")
+	}
+}
+
+func TestInstallMissingLink(t *testing.T) {
+	repoDir, _, err := setUpTestRepo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(repoDir)
+	m := newTestManager(t)
+	pkg := &Package{URL: repoDir, Version: "v1.0", Src: "tasks", Dest: "roles/a"}
+	if _, err := m.Install([]*Package{pkg}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(pkg.destPath(m.WorkDir)); err != nil {
+		t.Fatal(err)
+	}
+	// the content is up to date within the storage, but the destination is linked again
+	results, err := m.Install([]*Package{pkg}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Status != StatusInstalled {
+		t.Errorf("unexpected result %+v", results[0])
+	}
+	if _, err := os.Lstat(pkg.destPath(m.WorkDir)); err != nil {
+		t.Error(err)
+	}
+	if results, err = m.Install([]*Package{pkg}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Status != StatusUpToDate {
+		t.Errorf("unexpected result %+v", results[0])
+	}
+}
+
+func TestInstallRollback(t *testing.T) {
+	repoDir, _, err := setUpTestRepo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(repoDir)
+	m := newTestManager(t)
+	p := &Package{URL: repoDir, Version: "v1.0", Src: "tasks", Dest: "roles/tag"}
+	results, err := m.Install([]*Package{p}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Status != StatusInstalled || results[0].Commit == "" || results[0].StoragePath == "" {
+		t.Errorf("unexpected results %+v", results[0])
+	}
+	// the destination is replaced by a regular directory, so linking fails
+	dest := filepath.Join(m.WorkDir, p.Dest)
+	os.Remove(dest)
+	os.Mkdir(dest, 0755)
+	results, err = m.Install([]*Package{p}, &InstallOptions{Force: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Status != StatusFailed || results[0].Error == "" {
+		t.Errorf("a failure is expected, got %+v", results[0])
+	}
+
+	if e, err := m.Storage.Lookup(p.URL, p.Src, p.Version); err != nil || !m.Storage.HasObject(e) {
+		t.Errorf("storage entry is expected to be kept: %v", err)
+	}
+	if _, err := filepath.EvalSymlinks(filepath.Join(m.WorkDir, LinksDir, p.Hash())); err != nil {
+		t.Errorf("previous link is expected to be restored: %s", err)
+	}
+	entries, _ := os.ReadDir(m.Storage.Root)
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), StagePrefix) {
+			t.Errorf("unexpected temporary entry %s", e.Name())
+		}
+	}
+}
+
+func TestIndexKey(t *testing.T) {
+	if IndexKey("https://a/b", "c", "") == IndexKey("https://a/bc", "", "") {
+		t.Error("index keys are expected to be different")
+	}
+}
+
+func TestStorageDedupe(t *testing.T) {
+	repoDir, repo, err := setUpTestRepo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(repoDir)
+	mirrorDir, _ := os.MkdirTemp("", "apm-mirror")
+	defer os.RemoveAll(mirrorDir)
+	if _, err := git.PlainClone(mirrorDir, false, &git.CloneOptions{URL: repoDir}); err != nil {
+		t.Fatal(err)
+	}
+	m := newTestManager(t)
+	origin := &Package{URL: repoDir, Version: "master", Src: "tasks", Dest: "roles/origin"}
+	mirror := &Package{URL: mirrorDir, Version: "v1.0", Src: "tasks", Dest: "roles/mirror"}
+	if _, err := m.Install([]*Package{origin, mirror}, nil); err != nil {
+		t.Fatal(err)
+	}
+	e1, _ := m.Storage.Lookup(origin.URL, origin.Src, origin.Version)
+	e2, _ := m.Storage.Lookup(mirror.URL, mirror.Src, mirror.Version)
+	if e1 == nil || e2 == nil || m.Storage.ObjectPath(e1) != m.Storage.ObjectPath(e2) {
+		t.Fatal("identical content is expected to be stored once")
+	}
+
+	if _, err := commitTestFile(repo, repoDir, "tasks/main.yml", "--- # changed\n"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Install([]*Package{origin}, nil); err != nil {
+		t.Fatal(err)
+	}
+	e3, _ := m.Storage.Lookup(origin.URL, origin.Src, origin.Version)
+	if e3 == nil || e3.Commit == e1.Commit {
+		t.Fatal("branch is expected to be updated")
+	}
+	if old, err := m.Storage.Lookup(origin.URL, origin.Src, e1.Commit); err != nil || !m.Storage.HasObject(old) {
+		t.Error("previous revision is expected to stay available")
+	}
+}
+
+func TestInstallConcurrent(t *testing.T) {
+	repoDir, _, err := setUpTestRepo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(repoDir)
+	cwd, _ := os.Getwd()
+
+	storage, err := NewStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		m, err := New(&Options{WorkDir: t.TempDir(), Storage: storage})
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p := &Package{URL: repoDir, Version: "v1.0", Src: "tasks", Dest: "roles/tag"}
+			if _, err := m.Install([]*Package{p}, nil); err != nil {
+				t.Error(err)
+				return
+			}
+			if _, err := os.Stat(filepath.Join(m.WorkDir, p.Dest, "main.yml")); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if wd, _ := os.Getwd(); wd != cwd {
+		t.Errorf("current directory is changed to %s", wd)
+	}
+}
+
+func TestState(t *testing.T) {
+	m := newTestManager(t)
+	state, err := m.LoadState()
+	if err != nil || len(state.Groups) != 0 || len(state.Without) != 0 {
+		t.Fatalf("unexpected initial state %v: %v", state, err)
+	}
+	if err := m.SaveState(&State{Groups: []string{"dev"}, Without: []string{"test"}}); err != nil {
+		t.Fatal(err)
+	}
+	state, err = m.LoadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Groups) != 1 || state.Groups[0] != "dev" || len(state.Without) != 1 || state.Without[0] != "test" {
+		t.Errorf("unexpected state %v", state)
+	}
+}
+
+func TestInstallDependencies(t *testing.T) {
+	dirs := make([]string, 3)
+	repos := make([]*git.Repository, 3)
+	for i := range dirs {
+		dir, repo, err := setUpTestRepo()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		dirs[i], repos[i] = dir, repo
+	}
+	a, b, c := dirs[0], dirs[1], dirs[2]
+	hash, err := commitTestFile(repos[2], c, "tasks/main.yml", "---\n# v1.1\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repos[2].CreateTag("v1.1", hash, nil); err != nil {
+		t.Fatal(err)
+	}
+	// a requires b and c ^1.0, b requires c ~1.0.0 and a. The requirement on c is included from the package.
+	if _, err := commitTestFile(repos[0], a, "deps/common.yml", `
+packages:
+- src: `+c+`
+  mappings:
+    - src: .
+      dest: roles/common
+      version: ^1.0
+`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := commitTestFile(repos[0], a, DependencyFile, `
+include:
+  - path: deps/common.yml
+packages:
+- src: `+b+`
+  mappings:
+    - src: .
+      dest: roles/b
+`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := commitTestFile(repos[1], b, RoleMetaFile, `
+dependencies:
+  - role: `+c+`
+    version: ~1.0.0
+    name: common
+  - src: `+a+`
+    name: a
+  - role: geerlingguy.java
+`); err != nil {
+		t.Fatal(err)
+	}
+
+	m := newTestManager(t)
+	root := &Package{URL: a, Version: "master", Dest: "roles/a"}
+	if _, err := m.Install([]*Package{root}, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, dest := range []string{"roles/a", "roles/b", "roles/common"} {
+		if _, err := os.Stat(filepath.Join(m.WorkDir, dest, "tasks/main.yml")); err != nil {
+			t.Errorf("%s is not installed: %s", dest, err)
+		}
+	}
+	data, _ := os.ReadFile(filepath.Join(m.WorkDir, "roles/common/tasks/main.yml"))
+	if strings.Contains(string(data), "v1.1") {
+		t.Error("v1.0 of roles/common satisfies all requirements")
+	}
+
+	nodes := m.Tree([]*Package{{URL: a, Version: "master", Dest: "roles/a"}})
+	if len(nodes) != 1 || len(nodes[0].Children) != 2 {
+		t.Fatalf("unexpected tree %v", nodes)
+	}
+	// included packages precede the packages of the file
+	deps := nodes[0].Children[1].Children
+	if len(deps) != 2 {
+		t.Fatalf("unexpected dependencies of roles/b %v", deps)
+	}
+	if deps[0].Duplicate != nodes[0].Children[0] {
+		t.Error("roles/common is expected to be deduplicated")
+	}
+	// the installed version of the duplicate satisfies the range
+	if v := nodes[0].Children[0].Package.Version; v != "v1.0" || deps[0].Conflicts() {
+		t.Errorf("roles/common is expected to be v1.0 without conflicts, got %s", v)
+	}
+	if deps[1].Err == nil || !strings.Contains(deps[1].Err.Error(), "cycle") {
+		t.Errorf("a cycle is expected, got %v", deps[1].Err)
+	}
+}
+
+func TestResolveDiamond(t *testing.T) {
+	dirs := make([]string, 5)
+	repos := make([]*git.Repository, 5)
+	for i := range dirs {
+		dir, repo, err := setUpTestRepo()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		dirs[i], repos[i] = dir, repo
+	}
+	x, y, a, b, c := dirs[0], dirs[1], dirs[2], dirs[3], dirs[4]
+	commit := func(k int, name string, content string, tag string) {
+		hash, err := commitTestFile(repos[k], dirs[k], name, content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tag != "" {
+			if _, err := repos[k].CreateTag(tag, hash, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	requires := func(url string, dest string, version string, hooks string) string {
+		return "packages:\n- src: " + url + "\n  mappings:\n    - dest: " + dest + "\n      version: \"" + version + "\"\n" + hooks
+	}
+	// the hook reveals every installation of roles/c
+	hook := "      hooks:\n        post_install: echo \"$APM_VERSION\" >> \"$APM_WORKDIR/hooks.log\"\n"
+	// x requires a >=1.5.0 and y requires b which requires a <2.0.0, a v1 and v2 require different majors of c
+	commit(0, DependencyFile, requires(a, "roles/a", ">=1.5.0", ""), "")
+	commit(1, DependencyFile, requires(b, "roles/b", "master", ""), "")
+	commit(3, DependencyFile, requires(a, "roles/a", "<2.0.0", ""), "")
+	commit(2, DependencyFile, requires(c, "roles/c", "^1.0.0", hook), "v1.5.0")
+	commit(2, DependencyFile, requires(c, "roles/c", "^2.0.0", hook), "v2.5.0")
+	commit(4, "tasks/main.yml", "# v1\n", "v1.5.0")
+	commit(4, "tasks/main.yml", "# v2\n", "v2.5.0")
+
+	m := newTestManager(t)
+	roots := []*Package{{URL: x, Version: "master", Dest: "roles/x"}, {URL: y, Version: "master", Dest: "roles/y"}}
+	results, err := m.Install(roots, &InstallOptions{Hooks: HookOptions{AllowProvided: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	versions := make(map[string]string)
+	for _, r := range results {
+		if r.Status == StatusFailed {
+			t.Errorf("%s: %s", r.Dest, r.Error)
+		}
+		if r.Status != StatusDuplicate {
+			versions[r.Dest] = r.Version
+		}
+	}
+	if versions["roles/a"] != "v1.5.0" || versions["roles/c"] != "v1.5.0" {
+		t.Errorf("unexpected versions %v", versions)
+	}
+	if data, _ := os.ReadFile(filepath.Join(m.WorkDir, "roles/c/tasks/main.yml")); string(data) != "# v1\n" {
+		t.Errorf("unexpected content of roles/c %q", data)
+	}
+	if data, _ := os.ReadFile(filepath.Join(m.WorkDir, "hooks.log")); string(data) != "v1.5.0\n" {
+		t.Errorf("hooks are expected to be run for the settled version only, got %q", data)
+	}
+}
+
+func TestResolveVersions(t *testing.T) {
+	dir, repo, err := setUpTestRepo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, tag := range []string{"v1.1.0", "v2.0.0"} {
+		hash, err := commitTestFile(repo, dir, "tasks/main.yml", "---\n# "+tag+"\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := repo.CreateTag(tag, hash, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	versions := func(url string) ([]string, error) {
+		return []string{"master", "v1.0", "v1.1.0", "v2.0.0"}, nil
+	}
+	pkg := &Package{URL: dir, Src: "tasks"}
+	tests := []struct {
+		required  []string
+		overrides map[string]string
+		want      string
+	}{
+		{[]string{"^1.0"}, nil, "v1.1.0"},
+		{[]string{"^1.0", "<1.1"}, nil, "v1.0"},
+		{[]string{">=1.0", "v1.1.0"}, nil, "v1.1.0"},
+		{[]string{"master"}, nil, "master"},
+		{[]string{"^1.0", "^2.0"}, nil, ""},
+		{[]string{"master", "v1.0"}, nil, ""},
+		{[]string{"^1.0", "^2.0"}, map[string]string{dir: "v2.0.0"}, "v2.0.0"},
+	}
+	for _, tt := range tests {
+		res := newResolver(tt.overrides, versions)
+		for k, v := range tt.required {
+			res.require(&Package{URL: dir, Src: "tasks", Version: v}, fmt.Sprintf("roles/%d", k))
+		}
+		got, err := res.resolve(pkg, false)
+		if tt.want == "" {
+			if err == nil || !strings.Contains(err.Error(), "required by roles/1") {
+				t.Errorf("%v: expected a conflict, got %s", tt.required, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%v: got %s, want %s: %v", tt.required, got, tt.want, err)
+		}
+	}
+
+	// root packages keep their versions regardless of other mappings of the same source
+	res := newResolver(nil, versions)
+	res.require(&Package{URL: dir, Src: "tasks", Version: "^2.0"}, "roles/dep")
+	for _, v := range []string{"master", "v1.0", "^1.0"} {
+		want := v
+		if v == "^1.0" {
+			want = "v1.1.0"
+		}
+		if got, err := res.resolve(&Package{URL: dir, Src: "tasks", Version: v}, true); err != nil || got != want {
+			t.Errorf("root %s: got %s, want %s: %v", v, got, want, err)
+		}
+	}
+	if got, err := res.resolve(&Package{URL: dir, Src: "tasks", Version: "^2.0"}, false); err != nil || got != "v2.0.0" {
+		t.Errorf("dependency: got %s: %v", got, err)
+	}
+
+	// the root requirement is overridden to satisfy the dependency
+	m := newTestManager(t)
+	opts := &InstallOptions{Overrides: map[string]string{dir: "v2.0.0"}}
+	if _, err := m.Install([]*Package{{URL: dir, Src: "tasks", Version: "^1.0", Dest: "roles/a"}}, opts); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(filepath.Join(m.WorkDir, "roles/a/main.yml"))
+	if !strings.Contains(string(data), "v2.0.0") {
+		t.Errorf("the overridden version is expected, got %q", data)
+	}
+	// available versions are listed from the remote
+	if _, err := m.Install([]*Package{{URL: dir, Src: "tasks", Version: "^1.0", Dest: "roles/b"}}, nil); err != nil {
+		t.Fatal(err)
+	}
+	data, _ = os.ReadFile(filepath.Join(m.WorkDir, "roles/b/main.yml"))
+	if !strings.Contains(string(data), "v1.1.0") {
+		t.Errorf("the latest matching version is expected, got %q", data)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	repoDir, _, err := setUpTestRepo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(repoDir)
+	m := newTestManager(t)
+	pkgs := []*Package{
+		{URL: repoDir, Version: "v1.0", Src: "tasks", Dest: "roles/a"},
+		{URL: repoDir, Version: "v1.0", Src: ".", Dest: "roles/b"},
+		{URL: repoDir, Version: "v1.0", Src: "tasks/main.yml", Dest: "roles/c/main.yml"},
+		{URL: repoDir, Version: "v1.0", Src: "tasks", Dest: "roles/d"},
+	}
+	if _, err := m.Install(pkgs, nil); err != nil {
+		t.Fatal(err)
+	}
+	statuses, err := m.Status(pkgs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range statuses {
+		if !s.InSync() {
+			t.Errorf("%s is expected to be installed, got %+v", s.Dest, s)
+		}
+	}
+
+	e, err := m.Storage.Lookup(repoDir, "tasks/main.yml", "v1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(m.Storage.ObjectPath(e), []byte("--- # changed\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(filepath.Join(m.WorkDir, "roles/a"))
+	os.Remove(filepath.Join(m.WorkDir, LinksDir, pkgs[1].Hash()))
+	current := []*Package{
+		pkgs[0],
+		pkgs[1],
+		pkgs[2],
+		{URL: repoDir, Version: "master", Src: "tasks", Dest: "roles/e"},
+		{URL: repoDir, Version: "^2.0", Src: "tasks", Dest: "roles/d"},
+	}
+	want := map[string]MappingState{
+		"roles/a":          MappingMissing,
+		"roles/b":          MappingDangling,
+		"roles/c/main.yml": MappingModified,
+		"roles/e":          MappingMissing,
+		"roles/d":          MappingDrift,
+	}
+	if statuses, err = m.Status(current, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != len(want) {
+		t.Errorf("unexpected statuses %d", len(statuses))
+	}
+	for _, s := range statuses {
+		if want[s.Dest] != s.State {
+			t.Errorf("%s: want %s, got %s", s.Dest, want[s.Dest], s.State)
+		}
+	}
+
+	// the mapping is removed from the requirements
+	statuses, err = m.Status(current[:3], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := statuses[len(statuses)-1]; s.Dest != "roles/d" || s.State != MappingOrphaned || s.Installed != "v1.0" {
+		t.Errorf("roles/d is expected to be orphaned, got %+v", s)
+	}
+}
+
+func TestDoctor(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	repoDir, _, err := setUpTestRepo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(repoDir)
+	m := newTestManager(t)
+	pkgs := []*Package{
+		{URL: repoDir, Version: "v1.0", Src: "tasks", Dest: "roles/a"},
+		{URL: repoDir, Version: "v1.0", Src: ".", Dest: "roles/b"},
+	}
+	if _, err := m.Install(pkgs, nil); err != nil {
+		t.Fatal(err)
+	}
+	// the storage is wiped
+	e, err := m.Storage.Lookup(repoDir, "tasks", "v1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.RemoveAll(m.Storage.ObjectPath(e))
+	// the destination is replaced by a directory
+	dest := filepath.Join(m.WorkDir, "roles/b")
+	os.Remove(dest)
+	os.Mkdir(dest, 0755)
+	// a crashed run leaves a staging directory within the storage, a copy next to the destination and a clone
+	old := time.Now().Add(-2 * DefaultStaleAge)
+	stale := []string{
+		filepath.Join(m.Storage.Root, StagePrefix+"crashed"),
+		filepath.Join(m.WorkDir, "roles", StagePrefix+"crashed"),
+		filepath.Join(tmp, DefaultTmpPrefix+"crashed"),
+	}
+	for _, name := range stale {
+		os.Mkdir(name, 0755)
+		os.Chtimes(name, old, old)
+	}
+	// files of other tools and running installations are kept
+	others := []string{
+		filepath.Join(m.WorkDir, "roles", "other"),
+		filepath.Join(m.Storage.Root, StagePrefix+"running"),
+	}
+	for _, name := range others {
+		os.Mkdir(name, 0755)
+	}
+	os.Chtimes(others[0], old, old)
+
+	problems, err := m.Doctor(pkgs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kinds := make(map[ProblemKind]int)
+	for _, p := range problems {
+		kinds[p.Kind]++
+		if p.Fixed {
+			t.Errorf("%s is not expected to be fixed without --fix", p.Path)
+		}
+	}
+	if kinds[ProblemDanglingLink] != 1 || kinds[ProblemNotLink] != 1 || kinds[ProblemStaleTemp] != len(stale) {
+		t.Fatalf("unexpected problems %v", kinds)
+	}
+
+	if problems, err = m.Doctor(pkgs, &DoctorOptions{Fix: true}); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range problems {
+		if !p.Fixed {
+			t.Errorf("%s is expected to be fixed: %s", p.Path, p.Error)
+		}
+	}
+	if _, err := os.Stat(dest + BackupSuffix); err != nil {
+		t.Errorf("the directory is expected to be kept: %s", err)
+	}
+	for _, name := range stale {
+		if _, err := os.Stat(name); !os.IsNotExist(err) {
+			t.Errorf("%s is expected to be removed", name)
+		}
+	}
+	for _, name := range others {
+		if _, err := os.Stat(name); err != nil {
+			t.Errorf("%s is expected to be kept", name)
+		}
+	}
+	statuses, err := m.Status(pkgs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range statuses {
+		if !s.InSync() {
+			t.Errorf("%s is expected to be installed, got %+v", s.Dest, s)
+		}
+	}
+}
+
+func TestOrphanedLinks(t *testing.T) {
+	// clones left by other runs are not reported
+	t.Setenv("TMPDIR", t.TempDir())
+	repoDir, _, err := setUpTestRepo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(repoDir)
+	m := newTestManager(t)
+	previous := &Package{URL: repoDir, Version: "v1.0", Src: "tasks", Dest: "roles/a"}
+	if _, err := m.Install([]*Package{previous}, nil); err != nil {
+		t.Fatal(err)
+	}
+	// the version is changed within the requirements
+	current := &Package{URL: repoDir, Version: "master", Src: "tasks", Dest: "roles/a"}
+	if _, err := m.Install([]*Package{current}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(previous.linkPath(m.WorkDir)); !os.IsNotExist(err) {
+		t.Error("the link to the previous version is expected to be removed")
+	}
+
+	// a link is left by another tool or an interrupted run
+	e, err := m.Storage.Lookup(repoDir, "tasks", "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(m.Storage.ObjectPath(e), previous.linkPath(m.WorkDir)); err != nil {
+		t.Fatal(err)
+	}
+	statuses, err := m.Status([]*Package{current}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := statuses[len(statuses)-1]; s.State != MappingOrphaned {
+		t.Errorf("the link is expected to be orphaned, got %+v", s)
+	}
+	problems, err := m.Doctor([]*Package{current}, &DoctorOptions{Fix: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 1 || problems[0].Kind != ProblemOrphanedLink || !problems[0].Fixed {
+		t.Fatalf("unexpected problems %+v", problems)
+	}
+	if statuses, err = m.Status([]*Package{current}, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range statuses {
+		if !s.InSync() {
+			t.Errorf("%s is expected to be installed, got %+v", s.Dest, s)
+		}
+	}
+}
+
+func TestInstallNoLinkAndOverwrite(t *testing.T) {
+	repoDir, _, err := setUpTestRepo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(repoDir)
+	m := newTestManager(t)
+	p := &Package{URL: repoDir, Version: "v1.0", Src: "tasks", Dest: "roles/a"}
+	dest := filepath.Join(m.WorkDir, p.Dest)
+
+	if _, err := m.Install([]*Package{p}, &InstallOptions{NoLink: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(dest); !os.IsNotExist(err) {
+		t.Error("the destination is not expected to be linked")
+	}
+	if _, err := os.Stat(filepath.Join(p.linkPath(m.WorkDir), "main.yml")); err != nil {
+		t.Errorf("the package is expected to be prefetched: %s", err)
+	}
+
+	os.MkdirAll(dest, 0755)
+	results, err := m.Install([]*Package{p}, &InstallOptions{Overwrite: func(string) bool { return false }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Status != StatusFailed {
+		t.Errorf("the declined destination is expected to be kept, got %+v", results[0])
+	}
+	if _, err = m.Install([]*Package{p}, &InstallOptions{Overwrite: func(string) bool { return true }}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "main.yml")); err != nil {
+		t.Errorf("the destination is expected to be replaced: %s", err)
+	}
+	if info, err := os.Stat(dest + BackupSuffix); err != nil || !info.IsDir() {
+		t.Errorf("the destination is expected to be moved aside: %v", err)
+	}
+}
+
+func TestParsePackage(t *testing.T) {
+	cases := map[string]Package{
+		"github.com/k1nky/roles":                            {URL: "github.com/k1nky/roles"},
+		"github.com/k1nky/roles@v1.0#roles/common":          {URL: "github.com/k1nky/roles", Version: "v1.0", Src: "roles/common"},
+		"https://host/a,b.git@feature/x":                    {URL: "https://host/a,b.git", Version: "feature/x"},
+		"ssh://git@github.com/k1nky/roles.git#tasks":        {URL: "ssh://git@github.com/k1nky/roles.git", Src: "tasks"},
+		"git@github.com:k1nky/roles.git@^1.2":               {URL: "git@github.com:k1nky/roles.git", Version: "^1.2"},
+		"git@github.com:k1nky/roles.git":                    {URL: "git@github.com:k1nky/roles.git"},
+		"/srv/repos/roles@39d3c976b8d06bb81f37e806ff915c05": {URL: "/srv/repos/roles", Version: "39d3c976b8d06bb81f37e806ff915c05"},
+	}
+	for spec, want := range cases {
+		p, err := ParsePackage(spec)
+		if err != nil {
+			t.Errorf("%s: %s", spec, err)
+			continue
+		}
+		if !reflect.DeepEqual(*p, want) {
+			t.Errorf("%s: got %+v, want %+v", spec, *p, want)
+		}
+		if p.String() != spec {
+			t.Errorf("%s: got spec %s", spec, p.String())
+		}
+	}
+	for _, spec := range []string{"", "github.com/k1nky/roles@", "github.com/k1nky/roles#", "@v1.0"} {
+		if _, err := ParsePackage(spec); err == nil {
+			t.Errorf("%s: an error is expected", spec)
+		}
+	}
+	invalid := map[string]string{
+		"github.com/k1nky/roles@v1.0#tasks":    "../outside",
+		"github.com/k1nky/roles#tasks":         "/etc/roles",
+		"github.com/k1nky/roles":               ".apm/x",
+		"github.com/k1nky/roles#../../secrets": "roles/a",
+		"github.com/k1nky/roles#/etc":          "roles/a",
+	}
+	for spec, dest := range invalid {
+		p, err := ParsePackage(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.Dest = dest
+		if err := p.Validate(); err == nil {
+			t.Errorf("%s at %s: an error is expected", spec, dest)
+		}
+	}
+}
+
+func TestRemove(t *testing.T) {
+	repoDir, _, err := setUpTestRepo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(repoDir)
+	m := newTestManager(t)
+	pkgs := []*Package{
+		{URL: repoDir, Version: "v1.0", Src: "tasks", Dest: "roles/a"},
+		{URL: repoDir, Version: "v1.0", Src: "tasks", Dest: "roles/b"},
+	}
+	if _, err := m.Install(pkgs, nil); err != nil {
+		t.Fatal(err)
+	}
+	link := pkgs[0].linkPath(m.WorkDir)
+
+	results, err := m.Remove(pkgs[:1], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Status != StatusRemoved {
+		t.Errorf("unexpected result %+v", results[0])
+	}
+	if _, err := os.Lstat(link); err != nil {
+		t.Error("the link is expected to be kept while it is used")
+	}
+	if _, err := m.Remove(pkgs[1:], nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(link); !os.IsNotExist(err) {
+		t.Error("the unused link is expected to be removed")
+	}
+
+	os.MkdirAll(filepath.Join(m.WorkDir, "roles/c"), 0755)
+	if results, err = m.Remove([]*Package{{Dest: "roles/c"}}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Status != StatusFailed {
+		t.Error("a destination which is not a link is expected to be kept")
+	}
+}
+
+func TestFetchOffline(t *testing.T) {
+	repoDir, _, err := setUpTestRepo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(repoDir)
+	storage, err := NewStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	workdir := filepath.Join(t.TempDir(), "project")
+	fetcher, err := New(&Options{WorkDir: workdir, Storage: storage, NoSetup: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkgs := []*Package{
+		{URL: repoDir, Version: "^1.0", Src: "tasks", Dest: "roles/a"},
+		{URL: repoDir, Version: "master", Src: ".", Dest: "roles/b"},
+	}
+	results, err := fetcher.Fetch(pkgs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range results {
+		if r.Status != StatusInstalled || r.StoragePath == "" {
+			t.Errorf("unexpected result %+v", r)
+		}
+	}
+	if _, err := os.Stat(workdir); !os.IsNotExist(err) {
+		t.Error("the working directory is not expected to be touched")
+	}
+
+	// the remote is not available anymore
+	os.RemoveAll(repoDir)
+	m, err := New(&Options{WorkDir: workdir, Storage: storage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results, err = m.Install(pkgs, &InstallOptions{Offline: true}); err != nil {
+		t.Fatal(err)
+	}
+	// the content is fetched, but the destinations are linked
+	for _, r := range results {
+		if r.Status != StatusInstalled {
+			t.Errorf("unexpected result %+v", r)
+		}
+	}
+	if results, err = m.Install(pkgs, &InstallOptions{Offline: true}); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range results {
+		if r.Status != StatusUpToDate {
+			t.Errorf("unexpected result %+v", r)
+		}
+	}
+	if results[0].Version != "v1.0" {
+		t.Errorf("the range is expected to be resolved offline, got %s", results[0].Version)
+	}
+	missing := &Package{URL: repoDir, Version: "v2.0", Dest: "roles/c"}
+	if results, err = m.Install([]*Package{missing}, &InstallOptions{Offline: true}); err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Status != StatusFailed {
+		t.Errorf("a package which is not fetched is expected to fail, got %+v", results[0])
+	}
+}
+
+func TestLockfile(t *testing.T) {
+	repoDir, repo, err := setUpTestRepo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(repoDir)
+	m := newTestManager(t)
+	pkgs := []*Package{
+		{URL: repoDir, Version: "master", Src: "tasks", Dest: "roles/branch"},
+		{URL: repoDir, Version: ">=1.0", Src: "tasks", Dest: "roles/range"},
+	}
+	results, err := m.Install(pkgs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := LockfilePath(filepath.Join(t.TempDir(), "requirements.yml"))
+	lock := &Lockfile{}
+	lock.Update(results, nil)
+	if err := lock.WriteFile(name); err != nil {
+		t.Fatal(err)
+	}
+	if lock, err = ReadLockfile(name); err != nil {
+		t.Fatal(err)
+	}
+	if len(lock.Packages) != 2 || lock.Packages[1].Package != repoDir+"@v1.0#tasks" {
+		t.Fatalf("unexpected lockfile %+v", lock.Packages)
+	}
+
+	hash, err := commitTestFile(repo, repoDir, "tasks/main.yml", "--- # changed\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.CreateTag("v1.1", hash, nil); err != nil {
+		t.Fatal(err)
+	}
+	check := func(content string, version string) {
+		t.Helper()
+		if data, _ := os.ReadFile(filepath.Join(m.WorkDir, "roles/branch/main.yml")); string(data) != content {
+			t.Errorf("roles/branch: want %q, got %q", content, data)
+		}
+		key, _ := m.linkKey(filepath.Join(m.WorkDir, "roles/range"))
+		if e, err := m.Storage.Entry(key); err != nil || e.Ref != version {
+			t.Errorf("roles/range: want %s, got %+v", version, e)
+		}
+	}
+	if _, err := m.Install(pkgs, &InstallOptions{Lock: lock}); err != nil {
+		t.Fatal(err)
+	}
+	check("---\n", "v1.0")
+
+	// the lock is not used, so the newest revisions are installed
+	if _, err := m.Install(pkgs, nil); err != nil {
+		t.Fatal(err)
+	}
+	check("--- # changed\n", "v1.1")
+	statuses, err := m.Status(pkgs, lock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range statuses {
+		if s.State != MappingDrift {
+			t.Errorf("%s is expected to differ from the lockfile, got %+v", s.Dest, s)
+		}
+	}
+
+	// locked revisions are installed from the storage without network
+	os.RemoveAll(repoDir)
+	if results, err = m.Install(pkgs, &InstallOptions{Lock: lock}); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range results {
+		if r.Status == StatusFailed {
+			t.Errorf("unexpected result %+v", r)
+		}
+	}
+	check("---\n", "v1.0")
+	if statuses, err = m.Status(pkgs, lock); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range statuses {
+		if !s.InSync() {
+			t.Errorf("%s is expected to be installed as locked, got %+v", s.Dest, s)
+		}
+	}
+}
+
+func TestBundle(t *testing.T) {
+	repoDir, _, err := setUpTestRepo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(repoDir)
+	m := newTestManager(t)
+	pkgs := []*Package{
+		{URL: repoDir, Version: "^1.0", Src: "tasks", Dest: "roles/a"},
+		{URL: repoDir, Version: "v1.0", Src: "tasks/main.yml", Dest: "roles/b/main.yml"},
+	}
+	if _, err := m.Bundle(pkgs, ioutil.Discard); err == nil {
+		t.Error("packages are expected to be installed before bundling")
+	}
+	if _, err := m.Install(pkgs, nil); err != nil {
+		t.Fatal(err)
+	}
+	archive := &bytes.Buffer{}
+	results, err := m.Bundle(pkgs, archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results[0].Version != "v1.0" {
+		t.Errorf("unexpected results %+v", results)
+	}
+
+	os.RemoveAll(repoDir)
+	target := newTestManager(t)
+	manifest, err := target.Storage.Import(bytes.NewReader(archive.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Entries) != 2 {
+		t.Errorf("unexpected entries %+v", manifest.Entries)
+	}
+	if results, err = target.Install(pkgs, &InstallOptions{Offline: true}); err != nil {
+		t.Fatal(err)
+	}
+	// the content is imported, but the destinations are linked
+	for _, r := range results {
+		if r.Status != StatusInstalled {
+			t.Errorf("unexpected result %+v", r)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(target.WorkDir, "roles/b/main.yml")); err != nil {
+		t.Error(err)
+	}
+
+	// files are not written outside of the storage
+	evil := &bytes.Buffer{}
+	gz := gzip.NewWriter(evil)
+	tw := tar.NewWriter(gz)
+	manifestData := []byte("version: 1\n")
+	tw.WriteHeader(&tar.Header{Name: BundleManifest, Mode: 0644, Size: int64(len(manifestData)), Typeflag: tar.TypeReg})
+	tw.Write(manifestData)
+	tw.WriteHeader(&tar.Header{Name: "objects/x", Linkname: t.TempDir(), Typeflag: tar.TypeSymlink})
+	tw.WriteHeader(&tar.Header{Name: "objects/x/evil", Mode: 0644, Typeflag: tar.TypeReg})
+	tw.Close()
+	gz.Close()
+	if _, err := target.Storage.Import(evil); err == nil {
+		t.Error("an error is expected for a file outside of the bundle")
+	}
+}
+
+func TestHooks(t *testing.T) {
+	repoDir, repo, err := setUpTestRepo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(repoDir)
+	hash, err := commitTestFile(repo, repoDir, DependencyFile, "hooks:\n  post_install: touch \"$APM_WORKDIR/provided\"\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.CreateTag("v2.0", hash, nil); err != nil {
+		t.Fatal(err)
+	}
+	m := newTestManager(t)
+	marker := filepath.Join(m.WorkDir, "marker")
+	p := &Package{URL: repoDir, Version: "v2.0", Dest: "roles/a", Hooks: &Hooks{
+		PreInstall:  "touch hooked",
+		PostInstall: `echo "$APM_VERSION $APM_DEST" > "$APM_WORKDIR/marker"`,
+		PreRemove:   `test -f "$APM_STORAGE_PATH/apm.yml" && rm "$APM_WORKDIR/marker"`,
+	}}
+
+	results, err := m.Install([]*Package{p}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(marker); err != nil || string(data) != "v2.0 "+filepath.Join(m.WorkDir, "roles/a")+"\n" {
+		t.Errorf("unexpected output of the hook %q, %v", data, err)
+	}
+	if _, err := os.Stat(filepath.Join(m.WorkDir, "roles/a/hooked")); err != nil {
+		t.Error("hooks are expected to be run within the copy")
+	}
+	if _, err := os.Stat(filepath.Join(results[0].StoragePath, "hooked")); !os.IsNotExist(err) {
+		t.Error("hooks are not expected to change the storage")
+	}
+	if statuses, err := m.Status([]*Package{p}, nil); err != nil || statuses[0].State != MappingInstalled {
+		t.Errorf("unexpected status %+v, %v", statuses[0], err)
+	}
+	if _, err := os.Stat(filepath.Join(m.WorkDir, "provided")); !os.IsNotExist(err) {
+		t.Error("hooks of packages are expected to be skipped unless they are allowed")
+	}
+
+	os.Remove(marker)
+	if _, err := m.Install([]*Package{p}, &InstallOptions{Hooks: HookOptions{AllowProvided: true}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(marker); !os.IsNotExist(err) {
+		t.Error("hooks are not expected to be run for the same content")
+	}
+	if _, err := m.Install([]*Package{p}, &InstallOptions{Force: true, Hooks: HookOptions{AllowProvided: true}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(m.WorkDir, "provided")); err != nil {
+		t.Error("allowed hooks of packages are expected to be run")
+	}
+
+	if _, err := m.Remove([]*Package{p}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(marker); !os.IsNotExist(err) {
+		t.Error("pre_remove hook is expected to be run")
+	}
+
+	failed := []*Package{
+		{URL: repoDir, Version: "v1.0", Dest: "roles/b", Hooks: &Hooks{PostInstall: "echo broken; exit 3"}},
+		{URL: repoDir, Version: "v1.0", Dest: "roles/c", Hooks: &Hooks{PreInstall: "sleep 5"}},
+	}
+	results, err = m.Install(failed, &InstallOptions{Hooks: HookOptions{Timeout: 100 * time.Millisecond}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Status != StatusFailed || !strings.Contains(results[0].Error, "broken") {
+		t.Errorf("unexpected result %+v", results[0])
+	}
+	if results[1].Status != StatusFailed || !strings.Contains(results[1].Error, "timed out") {
+		t.Errorf("unexpected result %+v", results[1])
+	}
+	for _, p := range failed {
+		if _, err := os.Lstat(filepath.Join(m.WorkDir, p.Dest)); !os.IsNotExist(err) {
+			t.Errorf("%s is expected to be rolled back", p.Dest)
+		}
+	}
+}
+
+// countingDownloader counts clones of repositories by their urls
+type countingDownloader struct {
+	Downloader
+	gets map[string]int
+}
+
+func (d *countingDownloader) Get(url string, version string, dest string, options *downloader.Options) error {
+	d.gets[url]++
+	return d.Downloader.Get(url, version, dest, options)
+}
+
+func TestManifestReadOnce(t *testing.T) {
+	repoDir, repo, err := setUpTestRepo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(repoDir)
+	includeDir, includeRepo, err := setUpTestRepo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(includeDir)
+	if _, err := commitTestFile(includeRepo, includeDir, "deps.yml", "packages: []\n"); err != nil {
+		t.Fatal(err)
+	}
+	// the manifest declares hooks, so the package is copied and hooks are looked up several times
+	if _, err := commitTestFile(repo, repoDir, DependencyFile, `
+include:
+  - src: `+includeDir+`
+    path: deps.yml
+    version: master
+hooks:
+  post_install: "true"
+`); err != nil {
+		t.Fatal(err)
+	}
+	m := newTestManager(t)
+	d := &countingDownloader{Downloader: m.Downloader, gets: make(map[string]int)}
+	m.Downloader = d
+	p := &Package{URL: repoDir, Version: "master", Dest: "roles/a"}
+	results, err := m.Install([]*Package{p}, &InstallOptions{Hooks: HookOptions{AllowProvided: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Status != StatusInstalled {
+		t.Fatalf("unexpected result %+v", results[0])
+	}
+	if n := d.gets[includeDir]; n != 1 {
+		t.Errorf("the remote include is expected to be fetched once, got %d", n)
+	}
+}
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		match   bool
+	}{
+		{"*.conf", "app.conf", true},
+		{"*.conf", "etc/app.conf", true},
+		{"etc/*.conf", "etc/app.conf", true},
+		{"etc/*.conf", "etc/nginx/app.conf", false},
+		{"etc/**/*.conf", "etc/app.conf", true},
+		{"etc/**/*.conf", "etc/nginx/sites/app.conf", true},
+		{"**", "etc/app.conf", true},
+		{"etc/*.conf", "app.conf", false},
+	}
+	for _, tt := range tests {
+		if matchGlob(tt.pattern, tt.name) != tt.match {
+			t.Errorf("matchGlob(%q, %q) is expected to be %v", tt.pattern, tt.name, tt.match)
+		}
+	}
+}
+
+func TestInstallTemplate(t *testing.T) {
+	repoDir, repo, err := setUpTestRepo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(repoDir)
+	hash, err := commitTestFile(repo, repoDir, "etc/app.conf", "port={{ .port }}\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.CreateTag("v2.0", hash, nil); err != nil {
+		t.Fatal(err)
+	}
+	m := newTestManager(t)
+	p := &Package{URL: repoDir, Version: "v2.0", Dest: "conf", Template: &Template{Files: "*.conf", Values: map[string]string{"port": "8080"}}}
+	conf := filepath.Join(m.WorkDir, "conf/etc/app.conf")
+
+	results, err := m.Install([]*Package{p}, nil)
+	if err != nil || results[0].Status != StatusInstalled {
+		t.Fatalf("unexpected result %+v, %v", results, err)
+	}
+	if info, err := os.Lstat(filepath.Join(m.WorkDir, "conf")); err != nil || info.Mode()&os.ModeSymlink != 0 {
+		t.Fatal("the destination is expected to be a copy")
+	}
+	if data, _ := os.ReadFile(conf); string(data) != "port=8080\n" {
+		t.Errorf("unexpected rendered content %q", data)
+	}
+	if data, _ := os.ReadFile(filepath.Join(results[0].StoragePath, "etc/app.conf")); string(data) != "port={{ .port }}\n" {
+		t.Errorf("the storage is not expected to be changed, got %q", data)
+	}
+	if statuses, err := m.Status([]*Package{p}, nil); err != nil || len(statuses) != 1 || !statuses[0].InSync() {
+		t.Errorf("unexpected statuses %+v, %v", statuses, err)
+	}
+
+	p.Template.Values["port"] = "9090"
+	if statuses, _ := m.Status([]*Package{p}, nil); statuses[0].State != MappingDrift {
+		t.Errorf("changed values are expected to be a drift, got %+v", statuses[0])
+	}
+	if _, err := m.Install([]*Package{p}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(conf); string(data) != "port=9090\n" {
+		t.Errorf("the destination is expected to be rendered again, got %q", data)
+	}
+
+	os.WriteFile(conf, []byte("port=1\n"), 0644)
+	if statuses, _ := m.Status([]*Package{p}, nil); statuses[0].State != MappingModified {
+		t.Errorf("unexpected status %+v", statuses[0])
+	}
+	if results, _ := m.Remove([]*Package{p}, nil); results[0].Status != StatusFailed {
+		t.Error("a modified copy is expected to be kept")
+	}
+	if results, _ := m.Install([]*Package{p}, &InstallOptions{Force: true}); results[0].Status != StatusFailed {
+		t.Error("a modified copy is expected to be kept without overwrite")
+	}
+	os.WriteFile(conf, []byte("port=9090\n"), 0644)
+
+	link := &Package{URL: repoDir, Version: "v2.0", Dest: "conf"}
+	if results, err := m.Install([]*Package{link}, nil); err != nil || results[0].Status == StatusFailed {
+		t.Fatalf("unexpected result %+v, %v", results, err)
+	}
+	if info, err := os.Lstat(filepath.Join(m.WorkDir, "conf")); err != nil || info.Mode()&os.ModeSymlink == 0 {
+		t.Error("the rendered copy is expected to be replaced by a link")
+	}
+
+	p.Dest, p.Template.Values = "other", nil
+	if results, _ := m.Install([]*Package{p}, nil); results[0].Status != StatusFailed || !strings.Contains(results[0].Error, "port") {
+		t.Errorf("a missing value is expected to fail, got %+v", results[0])
+	}
+	if _, err := os.Lstat(filepath.Join(m.WorkDir, "other")); !os.IsNotExist(err) {
+		t.Error("a failed rendering is expected to leave nothing")
+	}
+
+	// a copy of a branch is rendered again when the branch moves
+	branch := &Package{URL: repoDir, Version: "master", Dest: "branch", Template: &Template{Files: "*.conf", Values: map[string]string{"port": "8080"}}}
+	if _, err := m.Install([]*Package{branch}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := commitTestFile(repo, repoDir, "etc/app.conf", "listen={{ .port }}\n"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Install([]*Package{branch}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(m.WorkDir, "branch/etc/app.conf")); string(data) != "listen=8080\n" {
+		t.Errorf("the copy is expected to follow the branch, got %q", data)
+	}
+}
+
+func TestInstallPatches(t *testing.T) {
+	repoDir, repo, err := setUpTestRepo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(repoDir)
+	for tag, content := range map[string]string{"v2.0": "- name: a\n  debug: msg=one\n", "v3.0": "- name: a\n  debug: msg=two\n"} {
+		hash, err := commitTestFile(repo, repoDir, "tasks/main.yml", content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := repo.CreateTag(tag, hash, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fix := filepath.Join(t.TempDir(), "fix.patch")
+	os.WriteFile(fix, []byte("--- a/main.yml\n+++ b/main.yml\n@@ -1,2 +1,2 @@\n - name: a\n-  debug: msg=one\n+  debug: msg=fixed\n"), 0644)
+	m := newTestManager(t)
+	pkgs := []*Package{
+		{URL: repoDir, Version: "v2.0", Src: "tasks", Dest: "roles/patched", Patches: []string{fix}},
+		{URL: repoDir, Version: "v2.0", Src: "tasks", Dest: "roles/origin"},
+	}
+
+	results, err := m.Install(pkgs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].StoragePath == results[1].StoragePath || pkgs[0].Hash() == pkgs[1].Hash() {
+		t.Error("patched content is expected to have its own key")
+	}
+	if data, _ := os.ReadFile(filepath.Join(m.WorkDir, "roles/patched/main.yml")); string(data) != "- name: a\n  debug: msg=fixed\n" {
+		t.Errorf("unexpected patched content %q", data)
+	}
+	if data, _ := os.ReadFile(filepath.Join(m.WorkDir, "roles/origin/main.yml")); string(data) != "- name: a\n  debug: msg=one\n" {
+		t.Errorf("unexpected content %q", data)
+	}
+	if results, _ := m.Install(pkgs[:1], nil); results[0].Status != StatusUpToDate {
+		t.Errorf("unexpected result %+v", results[0])
+	}
+
+	pkgs[0].Version = "v3.0"
+	results, err = m.Install(pkgs[:1], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Status != StatusFailed || !strings.Contains(results[0].Error, "fix.patch can not be applied") {
+		t.Errorf("a patch which does not apply is expected to fail, got %+v", results[0])
+	}
+	if data, _ := os.ReadFile(filepath.Join(m.WorkDir, "roles/patched/main.yml")); string(data) != "- name: a\n  debug: msg=fixed\n" {
+		t.Error("the installed version is expected to be kept")
+	}
+}
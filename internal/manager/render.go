@@ -0,0 +1,314 @@
+package manager
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/k1nky/apm/internal/copy"
+	"github.com/k1nky/apm/internal/parser"
+	"gopkg.in/yaml.v3"
+)
+
+// RenderedFile records destinations which are copies rather than links, it is located in LinksDir
+const RenderedFile = "rendered.yml"
+
+// Template renders files of a package with values. A package with a template is installed as a copy,
+// so the shared content within the storage is never changed.
+type Template struct {
+	// Files is a glob relative to the package root, `**` matches any number of directories.
+	// A glob without slashes matches base names of files.
+	Files  string
+	Values map[string]string
+}
+
+// Rendered describes a destination which is a copy of a package, i.e. the package has a template or hooks
+type Rendered struct {
+	// Key is a key of the link within LinksDir to the package content
+	Key string `yaml:"key"`
+	// Tree is the object of the copied content, the key refers to another object when a branch moves
+	Tree string `yaml:"tree"`
+	// Digest is a digest of the template and the hooks, the destination is copied again when it changes
+	Digest string `yaml:"digest"`
+	// Checksum is a digest of the copy after rendering and hooks, it detects local modifications
+	Checksum string `yaml:"checksum"`
+}
+
+// NewTemplate converts a template of requirements, nil is returned when there is no template
+func NewTemplate(t *parser.Template) *Template {
+	if t == nil {
+		return nil
+	}
+	return &Template{Files: t.Files, Values: t.Values}
+}
+
+// digest returns a digest of the glob and the values
+func (t *Template) digest() string {
+	names := make([]string, 0, len(t.Values))
+	for name := range t.Values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	h := sha256.New()
+	fmt.Fprintf(h, "%q\n", t.Files)
+	for _, name := range names {
+		fmt.Fprintf(h, "%q=%q\n", name, t.Values[name])
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// copyDigest returns a digest of the template and the hooks of the package
+func (p *Package) copyDigest() string {
+	h := sha256.New()
+	if p.Template != nil {
+		fmt.Fprintln(h, p.Template.digest())
+	}
+	fmt.Fprint(h, p.Hooks.digest())
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// isCopy reports whether the package is installed as a copy rather than a link, that is when it has a template
+// or hooks, including the hooks `own` declared by its content
+func (p *Package) isCopy(own *Hooks) bool {
+	return p.Template != nil || p.Hooks != nil || own != nil
+}
+
+// matchGlob reports whether the slash separated `name` matches `pattern`
+func matchGlob(pattern string, name string) bool {
+	if !strings.Contains(pattern, "/") {
+		ok, _ := path.Match(pattern, path.Base(name))
+		return ok
+	}
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern []string, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// renderFiles renders files within `root` which match the template, a single file `root` is matched by its name.
+// Symlinks and the .git directory are skipped. A value missing within the template values is an error.
+func (t *Template) renderFiles(root string) error {
+	return filepath.Walk(root, func(name string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && info.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, _ := filepath.Rel(root, name)
+		if rel == "." {
+			rel = info.Name()
+		}
+		rel = filepath.ToSlash(rel)
+		if !matchGlob(t.Files, rel) {
+			return nil
+		}
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		tmpl, err := template.New(rel).Option("missingkey=error").Parse(string(data))
+		if err != nil {
+			return err
+		}
+		out := &bytes.Buffer{}
+		if err = tmpl.Execute(out, t.Values); err != nil {
+			return err
+		}
+		return ioutil.WriteFile(name, out.Bytes(), info.Mode().Perm())
+	})
+}
+
+func (m *Manager) renderedPath() string {
+	return path.Join(m.WorkDir, LinksDir, RenderedFile)
+}
+
+// loadRendered reads the copied destinations by their paths relative to the working directory
+func (m *Manager) loadRendered() (map[string]*Rendered, error) {
+	records := make(map[string]*Rendered)
+	data, err := ioutil.ReadFile(m.renderedPath())
+	if os.IsNotExist(err) {
+		return records, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("%s: %s", RenderedFile, err)
+	}
+	return records, nil
+}
+
+// saveRendered writes the copied destinations, the previous ones are restored on rollback
+func (m *Manager) saveRendered(records map[string]*Rendered, tx *transaction) error {
+	data, err := yaml.Marshal(records)
+	if err != nil {
+		return err
+	}
+	return replaceFile(m.renderedPath(), data, tx)
+}
+
+// isInstalled reports whether the destination already provides the storage entry of the package as it is required
+func (m *Manager) isInstalled(p *Package, e *Entry, own *Hooks, records map[string]*Rendered) bool {
+	dest := p.destPath(m.WorkDir)
+	r := records[m.relDest(p)]
+	copied := p.isCopy(own)
+	if !copied || r == nil {
+		key, _ := m.linkKey(dest)
+		return !copied && key == p.Hash()
+	}
+	if _, err := os.Lstat(dest); err != nil {
+		return false
+	}
+	return r.Key == p.Hash() && r.Tree == e.Tree && r.Digest == p.copyDigest()
+}
+
+// destKey returns the key of the link within LinksDir to the content provided by the destination
+func (m *Manager) destKey(dest string) (string, error) {
+	records, err := m.loadRendered()
+	if err != nil {
+		return "", err
+	}
+	rel, _ := filepath.Rel(m.WorkDir, dest)
+	if r, ok := records[rel]; ok {
+		return r.Key, nil
+	}
+	return m.linkKey(dest)
+}
+
+// copyDest copies the package content next to the destination, renders the copy and replaces the destination with it.
+// The pre_install hooks are run within the copy before it replaces the destination and the post_install hooks
+// are run within the destination, the storage entry is never changed. `own` are the hooks declared by the content.
+func (m *Manager) copyDest(p *Package, e *Entry, own *Hooks, records map[string]*Rendered, opts *InstallOptions, tx *transaction) (err error) {
+	var stage string
+
+	dest := p.destPath(m.WorkDir)
+	if err = os.MkdirAll(path.Dir(dest), copy.Mode0755); err != nil {
+		return
+	}
+	if stage, err = ioutil.TempDir(path.Dir(dest), StagePrefix); err != nil {
+		return
+	}
+	defer os.RemoveAll(stage)
+
+	src := m.Storage.ObjectPath(e)
+	copied := path.Join(stage, path.Base(dest))
+	if e.Name != "" {
+		_, err = copy.CopyFile(src, copied)
+	} else if err = copy.CopyDir(src, copied, true); err == nil {
+		// objects are staged within temporary directories, the copy gets the usual mode
+		err = os.Chmod(copied, copy.Mode0755)
+	}
+	if err != nil {
+		return
+	}
+	if p.Template != nil {
+		if err = p.Template.renderFiles(copied); err != nil {
+			return fmt.Errorf("template of %s: %s", p.Dest, err)
+		}
+	}
+	if err = m.runHooks(PreInstall, p, own, src, copied, &opts.Hooks); err != nil {
+		return
+	}
+	if err = m.clearDest(p, records, opts, tx); err != nil {
+		return
+	}
+	if err = os.Rename(copied, dest); err != nil {
+		return
+	}
+	tx.onRollback(func() error {
+		return os.RemoveAll(dest)
+	})
+	// a failed hook rolls the destination back
+	if err = m.runHooks(PostInstall, p, own, src, dest, &opts.Hooks); err != nil {
+		return
+	}
+	r := &Rendered{Key: p.Hash(), Tree: e.Tree, Digest: p.copyDigest()}
+	if r.Checksum, err = Checksum(dest); err != nil {
+		return
+	}
+	records[m.relDest(p)] = r
+	return m.saveRendered(records, tx)
+}
+
+// clearDest removes the destination so the package can be placed there, the destination is restored on rollback.
+// Links and unmodified copies are replaced, other content is moved aside when InstallOptions.Overwrite allows it.
+// A record of the copy is removed from `records`.
+func (m *Manager) clearDest(p *Package, records map[string]*Rendered, opts *InstallOptions, tx *transaction) error {
+	dest := p.destPath(m.WorkDir)
+	rel := m.relDest(p)
+	info, err := os.Lstat(dest)
+	if os.IsNotExist(err) {
+		delete(records, rel)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(dest)
+		if err != nil {
+			return err
+		}
+		if err = os.Remove(dest); err != nil {
+			return err
+		}
+		tx.onRollback(func() error {
+			return os.Symlink(target, dest)
+		})
+		return nil
+	}
+	if r, ok := records[rel]; ok {
+		if sum, err := Checksum(dest); err == nil && sum == r.Checksum {
+			delete(records, rel)
+			trash := path.Join(path.Dir(dest), fmt.Sprintf("%s%s-%d", StagePrefix, path.Base(dest), time.Now().UnixNano()))
+			if err = os.Rename(dest, trash); err != nil {
+				return err
+			}
+			tx.onRollback(func() error {
+				return os.Rename(trash, dest)
+			})
+			tx.onCommit(func() {
+				os.RemoveAll(trash)
+			})
+			return nil
+		}
+	}
+	if opts.Overwrite == nil || !opts.Overwrite(dest) {
+		if _, ok := records[rel]; ok {
+			return fmt.Errorf("%s has been modified after installation", dest)
+		}
+		return fmt.Errorf("file %s already exists", dest)
+	}
+	delete(records, rel)
+	return moveAside(dest, tx)
+}
@@ -0,0 +1,250 @@
+package manager
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+)
+
+const (
+	// RootRequirer describes packages required by the requirements file itself
+	RootRequirer = "requirements"
+	// maxResolvePasses limits reinstallation when dependencies change resolved versions
+	maxResolvePasses = 5
+)
+
+// constraintPattern matches version ranges, e.g. `^1.2`, `>=1.0 <2.0`, `~1.2.3`, `1.x`
+var constraintPattern = regexp.MustCompile(`[\^~<>=*|, ]|(^|\.)[xX](\.|$)`)
+
+// IsConstraint reports whether `version` is a range of versions rather than a branch, tag or commit
+func IsConstraint(version string) bool {
+	return constraintPattern.MatchString(version)
+}
+
+// Satisfies reports whether the resolved `version` fulfills the `required` one
+func Satisfies(version string, required string) bool {
+	if version == required {
+		return true
+	}
+	if !IsConstraint(required) {
+		return false
+	}
+	c, err := semver.NewConstraint(required)
+	if err != nil {
+		return false
+	}
+	v, err := semver.NewVersion(version)
+	return err == nil && c.Check(v)
+}
+
+// requirement is a version of a package required by another package
+type requirement struct {
+	version string
+	by      string
+}
+
+func (r requirement) String() string {
+	return fmt.Sprintf("%s required by %s", r.version, r.by)
+}
+
+// resolver picks a single version of a package which satisfies all requirements of dependencies on it.
+// Root packages are mapped to their own destinations, so each of them keeps the version it names.
+type resolver struct {
+	// overrides force versions of packages by their urls
+	overrides map[string]string
+	// versions returns available versions of a repository
+	versions  func(url string) ([]string, error)
+	available map[string][]string
+	// required are the requirements recorded within the current pass
+	required map[string][]requirement
+	// previous are the requirements of the previous pass, they are used until their requirers are expanded again
+	previous map[string][]requirement
+	// expanded are the requirers which have recorded their requirements within the current pass
+	expanded map[string]bool
+	resolved map[string]resolution
+	// locked are the versions of the lockfile by sources of packages, they are picked while they satisfy
+	// the requirements, so available versions are not fetched
+	locked map[string][]string
+}
+
+// resolution is a version picked for a package
+type resolution struct {
+	pkg     Package
+	version string
+}
+
+func newResolver(overrides map[string]string, versions func(url string) ([]string, error)) *resolver {
+	return &resolver{
+		overrides: overrides,
+		versions:  versions,
+		available: make(map[string][]string),
+		required:  make(map[string][]requirement),
+		previous:  make(map[string][]requirement),
+		expanded:  make(map[string]bool),
+		resolved:  make(map[string]resolution),
+	}
+}
+
+// pass starts a new resolution pass. Requirements are recorded from scratch, so requirements of packages
+// which are replaced or dropped by the previous pass do not affect the next one.
+func (r *resolver) pass() {
+	r.previous, r.required = r.required, make(map[string][]requirement)
+	r.expanded = make(map[string]bool)
+	r.resolved = make(map[string]resolution)
+}
+
+// sourceKey identifies a package regardless of its version and destination
+func sourceKey(p *Package) string {
+	return p.URL + "\x00" + path.Clean(p.Src)
+}
+
+// expand marks that `by` has recorded all of its requirements within the current pass
+func (r *resolver) expand(by string) {
+	r.expanded[by] = true
+}
+
+// requirements returns the requirements on the package: the recorded ones within the current pass and
+// the previous ones of requirers which are not expanded yet
+func (r *resolver) requirements(key string) []requirement {
+	reqs := append([]requirement{}, r.required[key]...)
+	for _, req := range r.previous[key] {
+		if !r.expanded[req.by] {
+			reqs = append(reqs, req)
+		}
+	}
+	return reqs
+}
+
+// require records the version of the package required by `by`
+func (r *resolver) require(p *Package, by string) {
+	version := p.Version
+	if version == "" {
+		version = DefaultVersion
+	}
+	key := sourceKey(p)
+	for _, req := range r.required[key] {
+		if req.version == version && req.by == by {
+			return
+		}
+	}
+	r.required[key] = append(r.required[key], requirement{version: version, by: by})
+}
+
+// resolve returns a version of the package. A root package is resolved by its own requirement only,
+// a dependency is resolved by all known requirements of dependencies and the version is remembered.
+func (r *resolver) resolve(p *Package, root bool) (version string, err error) {
+	if root {
+		version = p.Version
+		if version == "" {
+			version = DefaultVersion
+		}
+		return r.pick(p, []requirement{{version: version, by: RootRequirer}})
+	}
+	// a failure is remembered as well, since it may be caused by requirements of the previous pass
+	version, err = r.pick(p, r.requirements(sourceKey(p)))
+	r.resolved[sourceKey(p)] = resolution{pkg: *p, version: version}
+	return
+}
+
+func (r *resolver) pick(p *Package, reqs []requirement) (string, error) {
+	var (
+		exact       *requirement
+		constraints []*semver.Constraints
+	)
+
+	if version, ok := r.overrides[p.URL]; ok {
+		return version, nil
+	}
+	if len(reqs) == 0 {
+		return p.Version, nil
+	}
+	conflict := func() error {
+		list := make([]string, 0, len(reqs))
+		for _, req := range reqs {
+			list = append(list, req.String())
+		}
+		return fmt.Errorf("no version of %s satisfies all requirements: %s", p.URL, strings.Join(list, ", "))
+	}
+
+	for k, req := range reqs {
+		if !IsConstraint(req.version) {
+			if exact != nil && exact.version != req.version {
+				return "", conflict()
+			}
+			exact = &reqs[k]
+			continue
+		}
+		c, err := semver.NewConstraint(req.version)
+		if err != nil {
+			return "", fmt.Errorf("invalid version %s: %s", req, err)
+		}
+		constraints = append(constraints, c)
+	}
+	check := func(v *semver.Version) bool {
+		for _, c := range constraints {
+			if !c.Check(v) {
+				return false
+			}
+		}
+		return true
+	}
+
+	if exact != nil {
+		if len(constraints) == 0 {
+			return exact.version, nil
+		}
+		if v, err := semver.NewVersion(exact.version); err == nil && check(v) {
+			return exact.version, nil
+		}
+		return "", conflict()
+	}
+
+	for _, version := range r.locked[sourceKey(p)] {
+		if v, err := semver.NewVersion(version); err == nil && check(v) {
+			return version, nil
+		}
+	}
+	available, ok := r.available[p.URL]
+	if !ok {
+		var err error
+		if available, err = r.versions(p.URL); err != nil {
+			return "", err
+		}
+		r.available[p.URL] = available
+	}
+	var best *semver.Version
+	version := ""
+	for _, name := range available {
+		v, err := semver.NewVersion(name)
+		if err != nil || !check(v) {
+			continue
+		}
+		if best == nil || v.GreaterThan(best) {
+			best, version = v, name
+		}
+	}
+	if best == nil {
+		return "", conflict()
+	}
+	return version, nil
+}
+
+// changed reports whether requirements recorded within the pass after resolution change any of the resolved versions
+func (r *resolver) changed() bool {
+	for _, res := range r.resolved {
+		v, err := r.pick(&res.pkg, r.required[sourceKey(&res.pkg)])
+		if err != nil {
+			if res.version != "" {
+				return true
+			}
+			continue
+		}
+		if v != res.version {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,53 @@
+package manager
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+
+	"gopkg.in/yaml.v3"
+)
+
+// StateFile keeps choices made for the working directory, it is located in LinksDir
+const StateFile = "state.yml"
+
+// State is remembered between runs within the working directory
+type State struct {
+	// Groups are the selected groups of requirements, all groups are selected when it is empty
+	Groups []string `yaml:"groups,omitempty"`
+	// Without are the excluded groups of requirements
+	Without []string `yaml:"without,omitempty"`
+}
+
+func (m *Manager) statePath() string {
+	return path.Join(m.WorkDir, LinksDir, StateFile)
+}
+
+// LoadState reads the state of the working directory. An empty state is returned if it has not been saved yet.
+func (m *Manager) LoadState() (*State, error) {
+	state := &State{}
+	data, err := ioutil.ReadFile(m.statePath())
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// SaveState atomically writes the state of the working directory
+func (m *Manager) SaveState(state *State) error {
+	data, err := yaml.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tx := &transaction{}
+	if err := replaceFile(m.statePath(), data, tx); err != nil {
+		return err
+	}
+	tx.Commit()
+	return nil
+}
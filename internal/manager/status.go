@@ -0,0 +1,252 @@
+package manager
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// MappingState is a state of a mapping within the working directory
+type MappingState string
+
+const (
+	MappingInstalled MappingState = "installed"
+	// MappingMissing means the destination or the link to the storage does not exist
+	MappingMissing MappingState = "missing"
+	// MappingDangling means the destination link does not point to existing content
+	MappingDangling MappingState = "dangling"
+	// MappingDrift means another version or another package is installed into the destination
+	MappingDrift MappingState = "drift"
+	// MappingModified means the destination is not a link or the installed content has been changed
+	MappingModified MappingState = "modified"
+	// MappingOrphaned means the link exists but the mapping is gone from the requirements
+	MappingOrphaned MappingState = "orphaned"
+)
+
+// MappingStatus describes a mapping within the working directory
+type MappingStatus struct {
+	Dest string `json:"dest" yaml:"dest"`
+	URL  string `json:"url,omitempty" yaml:"url,omitempty"`
+	Src  string `json:"src,omitempty" yaml:"src,omitempty"`
+	// Required is a version or a range of versions from the requirements
+	Required string `json:"required,omitempty" yaml:"required,omitempty"`
+	// Installed is a version installed into the destination
+	Installed string       `json:"installed,omitempty" yaml:"installed,omitempty"`
+	Commit    string       `json:"commit,omitempty" yaml:"commit,omitempty"`
+	State     MappingState `json:"state" yaml:"state"`
+	Detail    string       `json:"detail,omitempty" yaml:"detail,omitempty"`
+	// RequiredBy is a destination of the package which requires this one, it is empty for the root requirements
+	RequiredBy string `json:"required_by,omitempty" yaml:"required_by,omitempty"`
+}
+
+// InSync reports whether the mapping is installed as required
+func (s *MappingStatus) InSync() bool {
+	return s.State == MappingInstalled
+}
+
+// Status compares the packages and dependencies of installed ones with the working directory and the lockfile,
+// if it is given. Links to the storage which are not used by the packages are reported as orphaned.
+func (m *Manager) Status(pkgs []*Package, lock *Lockfile) ([]*MappingStatus, error) {
+	links, err := m.destLinks()
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]*MappingStatus, 0, len(pkgs))
+	used := make(map[string]bool)
+
+	nodes := m.resolve(pkgs, func(n *Node) ([]*Package, error) {
+		s := m.mappingStatus(n.Package, lock.Lookup(n.Package))
+		if n.Parent != nil {
+			s.RequiredBy = n.Parent.Package.Dest
+		}
+		statuses = append(statuses, s)
+		used[m.relDest(n.Package)] = true
+		if s.State == MappingMissing || s.State == MappingDangling {
+			return nil, nil
+		}
+		deps, err := m.Dependencies(n.Package)
+		if err != nil {
+			s.Detail = fmt.Sprintf("dependencies: %s", err)
+		}
+		return deps, nil
+	})
+	Walk(nodes, func(n *Node, depth int) {
+		// cycles refer to destinations which have been checked already
+		if n.Err != nil && !used[m.relDest(n.Package)] {
+			statuses = append(statuses, &MappingStatus{
+				Dest:     n.Package.Dest,
+				URL:      n.Package.URL,
+				Src:      n.Package.Src,
+				Required: n.Package.Version,
+				State:    MappingMissing,
+				Detail:   n.Err.Error(),
+			})
+		}
+	})
+
+	keys := make(map[string]bool)
+	for dest, key := range links {
+		keys[key] = true
+		if used[dest] {
+			continue
+		}
+		s := &MappingStatus{Dest: dest, State: MappingOrphaned}
+		if e, err := m.Storage.Entry(key); err == nil {
+			s.URL, s.Src, s.Installed, s.Commit = e.URL, e.Src, e.Ref, e.Commit
+		}
+		statuses = append(statuses, s)
+	}
+	entries, err := os.ReadDir(path.Join(m.WorkDir, LinksDir))
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.Type()&os.ModeSymlink == 0 || keys[entry.Name()] {
+			continue
+		}
+		s := &MappingStatus{State: MappingOrphaned, Detail: path.Join(LinksDir, entry.Name()) + " is not used"}
+		if e, err := m.Storage.Entry(entry.Name()); err == nil {
+			s.URL, s.Src, s.Installed, s.Commit = e.URL, e.Src, e.Ref, e.Commit
+		}
+		statuses = append(statuses, s)
+	}
+	return statuses, nil
+}
+
+// mappingStatus checks the destination of the package, the installed commit is compared with the `locked` one
+func (m *Manager) mappingStatus(p *Package, locked *Package) *MappingStatus {
+	s := &MappingStatus{Dest: p.Dest, URL: p.URL, Src: p.Src, Required: p.Version}
+	dest := p.destPath(m.WorkDir)
+
+	info, err := os.Lstat(dest)
+	if err != nil {
+		s.State = MappingMissing
+		return s
+	}
+	records, err := m.loadRendered()
+	if err != nil {
+		s.State, s.Detail = MappingMissing, err.Error()
+		return s
+	}
+	rendered := records[m.relDest(p)]
+	key := ""
+	if rendered != nil {
+		key = rendered.Key
+	} else if info.Mode()&os.ModeSymlink == 0 {
+		s.State, s.Detail = MappingModified, "not a link"
+		return s
+	} else if key, err = m.linkKey(dest); err != nil {
+		s.State, s.Detail = MappingDrift, err.Error()
+		return s
+	} else if _, err := os.Stat(dest); err != nil {
+		s.State, s.Detail = MappingDangling, err.Error()
+		return s
+	}
+	e, err := m.Storage.Entry(key)
+	if err != nil {
+		// the index entry has been removed, the link is the only thing to compare
+		if key == p.Hash() {
+			s.State, s.Installed = MappingInstalled, p.Version
+		} else {
+			s.State = MappingDrift
+		}
+		return s
+	}
+	s.Installed, s.Commit = e.Ref, e.Commit
+	switch {
+	case !sameSource(p, &Package{URL: e.URL, Src: e.Src}):
+		s.State, s.Detail = MappingDrift, fmt.Sprintf("%s is installed", Package{URL: e.URL, Version: e.Ref, Src: e.Src})
+	case !Satisfies(e.Ref, p.Version):
+		s.State = MappingDrift
+	case locked != nil && locked.Commit != e.Commit:
+		s.State, s.Detail = MappingDrift, fmt.Sprintf("%s is locked, %s is installed", locked.Commit, e.Commit)
+	default:
+		s.State, s.Detail = m.contentState(p, e, rendered)
+	}
+	return s
+}
+
+// contentState compares the installed content with the storage entry, or the copy with its record
+func (m *Manager) contentState(p *Package, e *Entry, rendered *Rendered) (MappingState, string) {
+	// an unreadable manifest is reported by hooks, so the package is considered a copy
+	mf, err := m.readManifest(p, m.Storage.ObjectPath(e))
+	copied := err != nil || p.isCopy(mf.hooks)
+	switch {
+	case rendered == nil && copied:
+		return MappingDrift, "the package is not copied"
+	case rendered != nil && !copied:
+		return MappingDrift, "a copy is installed"
+	case rendered != nil && rendered.Digest != p.copyDigest():
+		return MappingDrift, "the template or hooks have been changed"
+	case rendered != nil && rendered.Tree != e.Tree:
+		return MappingDrift, "another revision is copied"
+	case rendered != nil:
+		if sum, err := Checksum(p.destPath(m.WorkDir)); err != nil || sum != rendered.Checksum {
+			return MappingModified, "content has been changed"
+		}
+	case e.Checksum != "":
+		if sum, err := Checksum(m.Storage.ObjectPath(e)); err != nil || sum != e.Checksum {
+			return MappingModified, "content has been changed"
+		}
+	}
+	return MappingInstalled, ""
+}
+
+// linkKey returns the key of the link within LinksDir which the destination link points to
+func (m *Manager) linkKey(dest string) (string, error) {
+	target, err := os.Readlink(dest)
+	if err != nil {
+		return "", err
+	}
+	if !path.IsAbs(target) {
+		target = path.Join(path.Dir(dest), target)
+	}
+	links := path.Join(m.WorkDir, LinksDir)
+	if path.Dir(target) != links {
+		return "", fmt.Errorf("%s is not managed", target)
+	}
+	return path.Base(target), nil
+}
+
+// destLinks finds links within the working directory which point to LinksDir and rendered copies, they are mapped
+// from destinations relative to the working directory to the keys of links
+func (m *Manager) destLinks() (map[string]string, error) {
+	links := make(map[string]string)
+	err := filepath.Walk(m.WorkDir, func(name string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && (info.Name() == LinksDir || info.Name() == ".git") {
+			return filepath.SkipDir
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			return nil
+		}
+		if key, err := m.linkKey(name); err == nil {
+			dest, _ := filepath.Rel(m.WorkDir, name)
+			links[dest] = key
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	records, err := m.loadRendered()
+	if err != nil {
+		return nil, err
+	}
+	for dest, r := range records {
+		if _, err := os.Lstat(path.Join(m.WorkDir, dest)); err == nil {
+			links[dest] = r.Key
+		}
+	}
+	return links, nil
+}
+
+// relDest returns the destination of the package relative to the working directory
+func (m *Manager) relDest(p *Package) string {
+	rel, _ := filepath.Rel(m.WorkDir, p.destPath(m.WorkDir))
+	return rel
+}
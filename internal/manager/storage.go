@@ -0,0 +1,271 @@
+package manager
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/k1nky/apm/internal/copy"
+	"github.com/k1nky/apm/internal/downloader"
+	"github.com/k1nky/apm/internal/flock"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// ObjectsDir keeps content of packages keyed by a git hash of the source tree
+	ObjectsDir = "objects"
+	// IndexDir keeps index entries keyed by a hash of (url, src, ref)
+	IndexDir = "index"
+)
+
+// Storage is a content-addressable storage of packages.
+// Content of a package source is placed into `objects/<tree>` where <tree> is a git hash of the source
+// tree (or blob), so identical content from mirrors or re-tagged versions is stored once.
+// The index maps (url, src, ref) to objects. Objects are never replaced, so old revisions stay available.
+type Storage struct {
+	Root string
+}
+
+// Entry is an index entry of the storage
+type Entry struct {
+	URL    string             `yaml:"url"`
+	Src    string             `yaml:"src"`
+	Ref    string             `yaml:"ref"`
+	Type   downloader.RefType `yaml:"type"`
+	Commit string             `yaml:"commit"`
+	Tree   string             `yaml:"tree"`
+	// Name is a file name when the source is a single file
+	Name string `yaml:"name,omitempty"`
+	// Checksum is a digest of the content, it detects local modifications of the object
+	Checksum string `yaml:"checksum,omitempty"`
+	// Patches is a digest of patches applied to the content, patched content has its own key and object
+	Patches string `yaml:"patches,omitempty"`
+}
+
+// IndexKey returns a key of the index entry for (url, src, ref)
+func IndexKey(url string, src string, ref string) string {
+	return PatchedKey(url, src, ref, "")
+}
+
+// PatchedKey returns a key of the index entry for (url, src, ref) with applied patches of the digest `patches`.
+// It is the same as IndexKey without patches.
+func PatchedKey(url string, src string, ref string, patches string) string {
+	parts := []string{url, src, ref}
+	if patches != "" {
+		parts = append(parts, patches)
+	}
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(strings.Join(parts, "\x00"))))
+}
+
+// key returns a key of the entry indexed by `ref`
+func (e *Entry) key(ref string) string {
+	return PatchedKey(e.URL, e.Src, ref, e.Patches)
+}
+
+// patchedTree returns a name of the object with patched content of the tree
+func patchedTree(tree string, patches string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(tree+"\x00"+patches)))
+}
+
+// NewStorage returns the storage placed into `dir`. Required directories are created if missing.
+func NewStorage(dir string) (s *Storage, err error) {
+	if len(dir) == 0 {
+		dir = DefaultStoragePath
+	}
+	if strings.HasPrefix(dir, "~/") {
+		home, _ := os.UserHomeDir()
+		dir = filepath.Join(home, dir[2:])
+	}
+
+	s = &Storage{Root: dir}
+	for _, d := range []string{ObjectsDir, IndexDir} {
+		if err = os.MkdirAll(path.Join(s.Root, d), copy.Mode0755); err != nil && !os.IsExist(err) {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *Storage) indexPath(key string) string {
+	return path.Join(s.Root, IndexDir, key+".yml")
+}
+
+// Lookup returns the index entry for (url, src, ref)
+func (s *Storage) Lookup(url string, src string, ref string) (e *Entry, err error) {
+	return s.Entry(IndexKey(url, src, ref))
+}
+
+// Entry returns the index entry by its key
+func (s *Storage) Entry(key string) (e *Entry, err error) {
+	var data []byte
+
+	if data, err = ioutil.ReadFile(s.indexPath(key)); err != nil {
+		return
+	}
+	e = &Entry{}
+	err = yaml.Unmarshal(data, e)
+	return
+}
+
+// Refs returns the refs of the repository `url` which are indexed in the storage
+func (s *Storage) Refs(url string) (refs []string, err error) {
+	var files []fs.DirEntry
+
+	if files, err = os.ReadDir(path.Join(s.Root, IndexDir)); err != nil {
+		return
+	}
+	seen := make(map[string]bool)
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".yml") || strings.HasPrefix(f.Name(), StagePrefix) {
+			continue
+		}
+		e, err := s.Entry(strings.TrimSuffix(f.Name(), ".yml"))
+		if err != nil || e.URL != url || seen[e.Ref] {
+			continue
+		}
+		seen[e.Ref] = true
+		refs = append(refs, e.Ref)
+	}
+	sort.Strings(refs)
+	return refs, nil
+}
+
+// Lock acquires an exclusive lock on the index entry for (url, src, ref)
+func (s *Storage) Lock(url string, src string, ref string) (*flock.Lock, error) {
+	return flock.Acquire(path.Join(s.Root, IndexDir, IndexKey(url, src, ref)+".lock"))
+}
+
+// ObjectPath returns path to the content of the entry
+func (s *Storage) ObjectPath(e *Entry) string {
+	return path.Join(s.Root, ObjectsDir, e.Tree, e.Name)
+}
+
+// HasObject reports whether content of the entry is present in the storage
+func (s *Storage) HasObject(e *Entry) bool {
+	_, err := os.Lstat(s.ObjectPath(e))
+	return err == nil
+}
+
+// index adds the entry to the index for `ref`
+func (s *Storage) index(e *Entry, ref string, tx *transaction) (err error) {
+	var data []byte
+
+	entry := *e
+	entry.Ref = ref
+	if data, err = yaml.Marshal(entry); err != nil {
+		return
+	}
+	return replaceFile(s.indexPath(e.key(ref)), data, tx)
+}
+
+// Put places the content `src` into the storage unless the object already exists and indexes the entry
+// both for its ref and resolved commit.
+func (s *Storage) Put(e *Entry, src string, tx *transaction) (err error) {
+	var info fs.FileInfo
+
+	if info, err = os.Stat(src); err != nil {
+		return
+	}
+	e.Name = ""
+	if info.Mode().IsRegular() {
+		e.Name = path.Base(src)
+	}
+	if e.Checksum, err = Checksum(src); err != nil {
+		return
+	}
+	if !s.HasObject(e) {
+		if err = s.putObject(e, src); err != nil {
+			return
+		}
+	}
+	if err = s.index(e, e.Ref, tx); err != nil {
+		return
+	}
+	if e.Ref != e.Commit {
+		// keep the revision available by its commit, e.g. for locked entries
+		err = s.index(e, e.Commit, tx)
+	}
+	return
+}
+
+// putObject copies `src` to a staging directory next to the storage and then moves it to the objects.
+func (s *Storage) putObject(e *Entry, src string) (err error) {
+	var stage string
+
+	if stage, err = ioutil.TempDir(s.Root, StagePrefix); err != nil {
+		return
+	}
+	defer os.RemoveAll(stage)
+
+	objectDir := path.Join(s.Root, ObjectsDir, e.Tree)
+	if e.Name != "" {
+		if err = copy.Copy(src, path.Join(stage, e.Name), &copy.CopyOptions{}); err != nil {
+			return
+		}
+		if err = os.MkdirAll(objectDir, copy.Mode0755); err != nil {
+			return
+		}
+		return moveObject(path.Join(stage, e.Name), s.ObjectPath(e))
+	}
+
+	if err = copy.Copy(src, stage, &copy.CopyOptions{Plain: true}); err != nil {
+		return
+	}
+	return moveObject(stage, objectDir)
+}
+
+// moveObject renames the staged content to the object path. Objects are immutable and may be shared
+// with other entries, so an object which has appeared meanwhile is left as is and objects are not removed on rollback.
+func moveObject(stage string, object string) error {
+	if err := os.Rename(stage, object); err != nil {
+		if _, serr := os.Lstat(object); serr == nil {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// Checksum returns a digest of names, symlink targets and content of files within `src` ignoring
+// file modes and the .git directory, or a digest of `src` content when it is a file
+func Checksum(src string) (string, error) {
+	h := sha256.New()
+	err := filepath.Walk(src, func(name string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(src, name)
+		switch {
+		case info.IsDir() && info.Name() == ".git":
+			return filepath.SkipDir
+		case info.IsDir():
+			return nil
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(name)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, "%s\x00link\x00%s\x00", rel, target)
+			return nil
+		}
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		fmt.Fprintf(h, "%s\x00%d\x00", rel, info.Size())
+		_, err = io.Copy(h, f)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
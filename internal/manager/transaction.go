@@ -0,0 +1,97 @@
+package manager
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"github.com/k1nky/apm/internal/copy"
+)
+
+// StagePrefix is a name prefix of temporary files and directories where new content is prepared
+const StagePrefix = ".tmp-"
+
+// transaction keeps track of changes made during an installation of a package,
+// so they can be rolled back on failure.
+type transaction struct {
+	rollbacks []func() error
+	commits   []func()
+}
+
+func (tx *transaction) onRollback(f func() error) {
+	tx.rollbacks = append(tx.rollbacks, f)
+}
+
+// onCommit defers cleanups which can not be rolled back, e.g. removal of replaced content
+func (tx *transaction) onCommit(f func()) {
+	tx.commits = append(tx.commits, f)
+}
+
+// Rollback restores the previous state in reverse order of the changes.
+// It continues on errors and returns the first one.
+func (tx *transaction) Rollback() (err error) {
+	for i := len(tx.rollbacks) - 1; i >= 0; i-- {
+		if e := tx.rollbacks[i](); e != nil && err == nil {
+			err = e
+		}
+	}
+	tx.rollbacks, tx.commits = nil, nil
+	return
+}
+
+// Commit accepts the changes, so they can not be rolled back anymore.
+func (tx *transaction) Commit() {
+	for _, f := range tx.commits {
+		f()
+	}
+	tx.rollbacks, tx.commits = nil, nil
+}
+
+// replaceFile atomically writes `data` to the file `name`. The previous content is restored on rollback.
+func replaceFile(name string, data []byte, tx *transaction) (err error) {
+	var tmp *os.File
+
+	prev, prevErr := ioutil.ReadFile(name)
+	if prevErr != nil && !os.IsNotExist(prevErr) {
+		return prevErr
+	}
+	if tmp, err = ioutil.TempFile(path.Dir(name), StagePrefix); err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return
+	}
+	if err = tmp.Close(); err != nil {
+		return
+	}
+	if err = os.Chmod(tmp.Name(), copy.Mode0644); err != nil {
+		return
+	}
+	if err = os.Rename(tmp.Name(), name); err != nil {
+		return
+	}
+	tx.onRollback(func() error {
+		if os.IsNotExist(prevErr) {
+			return os.Remove(name)
+		}
+		return ioutil.WriteFile(name, prev, copy.Mode0644)
+	})
+	return
+}
+
+// replaceLink atomically points the symlink `name` to `target`.
+// A new symlink is created with a temporary name and then renamed over `name`.
+func replaceLink(name string, target string) (err error) {
+	tmp := path.Join(path.Dir(name), fmt.Sprintf("%s%s-%d", StagePrefix, path.Base(name), time.Now().UnixNano()))
+	if err = os.Symlink(target, tmp); err != nil {
+		return
+	}
+	if err = os.Rename(tmp, name); err != nil {
+		os.Remove(tmp)
+	}
+	return
+}
@@ -0,0 +1,289 @@
+package parser
+
+import (
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Format is a format of a requirements file
+type Format string
+
+const (
+	// NativeFormat describes `packages` with `mappings`
+	NativeFormat Format = "native"
+	// GalaxyFormat is ansible-galaxy requirements.yml with `roles` and `collections`
+	GalaxyFormat Format = "galaxy"
+
+	DefaultRolesPath       = "roles"
+	DefaultCollectionsPath = "collections"
+)
+
+// GalaxyOptions describe how ansible-galaxy requirements are mapped to packages
+type GalaxyOptions struct {
+	// RolesPath is a directory where roles are placed by their names
+	RolesPath string
+	// CollectionsPath is a directory which contains `ansible_collections`
+	CollectionsPath string
+}
+
+type galaxyRole struct {
+	// Role is used by dependencies within meta/main.yml
+	Role    string `yaml:"role"`
+	Src     string `yaml:"src"`
+	Scm     string `yaml:"scm"`
+	Version string `yaml:"version"`
+	Name    string `yaml:"name"`
+}
+
+type galaxyCollection struct {
+	Name    string `yaml:"name"`
+	Src     string `yaml:"src"`
+	Source  string `yaml:"source"`
+	Type    string `yaml:"type"`
+	Version string `yaml:"version"`
+}
+
+// isGalaxy reports whether `node` is ansible-galaxy requirements: a list of roles or
+// a mapping with `roles` or `collections`.
+func isGalaxy(node *yaml.Node) bool {
+	if node.Kind == yaml.SequenceNode {
+		return true
+	}
+	return valueNode(node, "packages") == nil && (valueNode(node, "roles") != nil || valueNode(node, "collections") != nil)
+}
+
+func (opts GalaxyOptions) rolesPath() string {
+	if opts.RolesPath == "" {
+		return DefaultRolesPath
+	}
+	return opts.RolesPath
+}
+
+func (opts GalaxyOptions) collectionsPath() string {
+	if opts.CollectionsPath == "" {
+		return DefaultCollectionsPath
+	}
+	return opts.CollectionsPath
+}
+
+// isGitUrl reports whether `src` points to a repository rather than to a content on Ansible Galaxy server
+func isGitUrl(src string) bool {
+	return strings.Contains(src, "://") || strings.HasPrefix(src, "git+") || scpLikeUrl.MatchString(src) || strings.HasPrefix(src, "/")
+}
+
+// repoName returns a name of a repository from its url, e.g. `https://host/org/role.git` => `role`
+func repoName(url string) string {
+	url = strings.TrimSuffix(strings.TrimRight(url, "/"), ".git")
+	if i := strings.LastIndexAny(url, "/:"); i != -1 {
+		url = url[i+1:]
+	}
+	return url
+}
+
+// splitGalaxySrc splits `git+url,version,name` into its parts
+func splitGalaxySrc(src string) (url string, version string, name string) {
+	chunks := strings.Split(strings.TrimPrefix(src, "git+"), ",")
+	url = chunks[0]
+	if len(chunks) > 1 {
+		version = chunks[1]
+	}
+	if len(chunks) > 2 {
+		name = chunks[2]
+	}
+	return
+}
+
+func (r *Requirements) galaxyRole(node *yaml.Node) (pkg RequiredPackage, err error) {
+	role := galaxyRole{}
+	if node.Kind == yaml.ScalarNode {
+		role.Src = node.Value
+	} else if err = node.Decode(&role); err != nil {
+		return
+	}
+	if role.Src == "" {
+		role.Src = role.Role
+	}
+	if role.Src == "" {
+		// the role name is used as src in the short form
+		role.Src = role.Name
+	}
+	if role.Scm != "" && role.Scm != "git" {
+		return pkg, newValidationError(r.Filename, keyNode(node, "scm"), "unsupported scm %s", role.Scm)
+	}
+	if !isGitUrl(role.Src) {
+		return pkg, newValidationError(r.Filename, keyNode(node, "src"), "role %s is hosted on Ansible Galaxy and is not supported", role.Src)
+	}
+	url, version, name := splitGalaxySrc(role.Src)
+	if role.Version != "" {
+		version = role.Version
+	}
+	if role.Name != "" && role.Name != role.Src {
+		name = role.Name
+	}
+	if name == "" {
+		name = repoName(url)
+	}
+	mapping := ReqiuredMapping{
+		Src:     ".",
+		Dest:    path.Join(r.Galaxy.rolesPath(), name),
+		Version: version,
+		node:    node,
+	}
+	return RequiredPackage{Url: url, Mappings: []ReqiuredMapping{mapping}, node: node}, nil
+}
+
+func (r *Requirements) galaxyCollection(node *yaml.Node) (pkg RequiredPackage, err error) {
+	var src, name string
+
+	coll := galaxyCollection{}
+	if node.Kind == yaml.ScalarNode {
+		coll.Name = node.Value
+	} else if err = node.Decode(&coll); err != nil {
+		return
+	}
+
+	switch {
+	case coll.Type != "" && coll.Type != "git":
+		return pkg, newValidationError(r.Filename, keyNode(node, "type"), "unsupported collection type %s", coll.Type)
+	case isGitUrl(coll.Name):
+		src = coll.Name
+	case isGitUrl(coll.Source):
+		src, name = coll.Source, coll.Name
+	case isGitUrl(coll.Src):
+		src, name = coll.Src, coll.Name
+	default:
+		return pkg, newValidationError(r.Filename, keyNode(node, "name"), "collection %s is hosted on Ansible Galaxy and is not supported", coll.Name)
+	}
+
+	url, version, _ := splitGalaxySrc(src)
+	// a path within the repository is passed as a fragment, e.g. git+https://host/repo.git#/collection
+	subdir := "."
+	if i := strings.Index(url, "#"); i != -1 {
+		url, subdir = url[:i], strings.TrimPrefix(url[i+1:], "/")
+		if subdir == "" {
+			subdir = "."
+		}
+	}
+	if coll.Version != "" {
+		version = coll.Version
+	}
+	if name == "" {
+		name = repoName(url)
+	}
+	namespace, collection, ok := splitCollectionName(name)
+	if !ok {
+		return pkg, newValidationError(r.Filename, node, "can not determine namespace of collection %s, expected name like namespace.collection", name)
+	}
+	mapping := ReqiuredMapping{
+		Src:     subdir,
+		Dest:    path.Join(r.Galaxy.collectionsPath(), "ansible_collections", namespace, collection),
+		Version: version,
+		node:    node,
+	}
+	return RequiredPackage{Url: url, Mappings: []ReqiuredMapping{mapping}, node: node}, nil
+}
+
+// splitCollectionName splits a fully qualified collection name `namespace.collection`
+func splitCollectionName(name string) (namespace string, collection string, ok bool) {
+	chunks := strings.Split(name, ".")
+	if len(chunks) != 2 || chunks[0] == "" || chunks[1] == "" {
+		return "", "", false
+	}
+	return chunks[0], chunks[1], true
+}
+
+// readGalaxy maps ansible-galaxy requirements to packages. Each role or collection becomes
+// a mapping of the whole repository (or its subdirectory) to a directory named after it.
+func (r *Requirements) readGalaxy(node *yaml.Node) error {
+	var (
+		errs  ValidationErrors
+		roles []*yaml.Node
+		colls []*yaml.Node
+	)
+
+	r.Packages = nil
+	r.Vars = nil
+	r.Extends = nil
+	r.Include = nil
+	r.Overrides = nil
+	r.Hooks = nil
+	r.Format = GalaxyFormat
+	if node.Kind == yaml.SequenceNode {
+		roles = node.Content
+	} else {
+		for _, key := range []string{"roles", "collections"} {
+			if v := valueNode(node, key); v != nil && v.Kind != yaml.SequenceNode && v.Tag != "!!null" {
+				errs = append(errs, newValidationError(r.Filename, v, "expected a list"))
+			}
+		}
+		if v := valueNode(node, "roles"); v != nil && v.Kind == yaml.SequenceNode {
+			roles = v.Content
+		}
+		if v := valueNode(node, "collections"); v != nil && v.Kind == yaml.SequenceNode {
+			colls = v.Content
+		}
+	}
+
+	add := func(pkg RequiredPackage, err error) {
+		if err != nil {
+			if e, ok := err.(*ValidationError); ok {
+				errs = append(errs, e)
+			} else {
+				errs = append(errs, &ValidationError{Filename: r.Filename, Message: err.Error()})
+			}
+			return
+		}
+		r.Add(pkg)
+	}
+	for _, role := range roles {
+		add(r.galaxyRole(role))
+	}
+	for _, coll := range colls {
+		add(r.galaxyCollection(coll))
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// ReadRoleDependencies maps dependencies from meta/main.yml of a role to packages, which are placed
+// into `rolesPath`. Dependencies which are not located in git repositories, e.g. roles from Ansible Galaxy,
+// are skipped and the reasons are returned.
+func ReadRoleDependencies(reader io.Reader, filename string, rolesPath string) (packages []RequiredPackage, skipped []string, err error) {
+	var (
+		data []byte
+		doc  yaml.Node
+	)
+
+	if data, err = ioutil.ReadAll(reader); err != nil {
+		return
+	}
+	if err = yaml.Unmarshal(data, &doc); err != nil {
+		return
+	}
+	if len(doc.Content) == 0 {
+		return
+	}
+	deps := valueNode(doc.Content[0], "dependencies")
+	if deps == nil || deps.Kind != yaml.SequenceNode {
+		return
+	}
+	r := &Requirements{Filename: filename, Galaxy: GalaxyOptions{RolesPath: rolesPath}}
+	for _, node := range deps.Content {
+		pkg, err := r.galaxyRole(node)
+		if e, ok := err.(*ValidationError); ok {
+			// a role from Ansible Galaxy or a role within the same roles path
+			skipped = append(skipped, e.Error())
+			continue
+		} else if err != nil {
+			return nil, nil, err
+		}
+		packages = append(packages, pkg)
+	}
+	return
+}
@@ -0,0 +1,70 @@
+package parser
+
+// groupsOf returns groups of the mapping along with groups of its package
+func groupsOf(pkg RequiredPackage, m ReqiuredMapping) []string {
+	if len(pkg.Groups) == 0 {
+		return m.Groups
+	}
+	groups := append([]string{}, pkg.Groups...)
+	for _, g := range m.Groups {
+		if !contains(groups, g) {
+			groups = append(groups, g)
+		}
+	}
+	return groups
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// flatten moves groups of the package into the mapping, so the mapping can be merged into another package
+func flatten(pkg RequiredPackage, m ReqiuredMapping) RequiredPackage {
+	m.Groups = groupsOf(pkg, m)
+	return RequiredPackage{Url: pkg.Url, Mappings: []ReqiuredMapping{m}}
+}
+
+// Selected reports whether the mapping of the package is installed with `groups` and `without` groups.
+// Mappings without groups are always selected, others are selected when they belong to one of `groups`
+// or `groups` is empty. Mappings in any of `without` groups are never selected.
+func Selected(pkg RequiredPackage, m ReqiuredMapping, groups []string, without []string) bool {
+	mgroups := groupsOf(pkg, m)
+	for _, g := range mgroups {
+		if contains(without, g) {
+			return false
+		}
+	}
+	if len(mgroups) == 0 || len(groups) == 0 {
+		return true
+	}
+	for _, g := range mgroups {
+		if contains(groups, g) {
+			return true
+		}
+	}
+	return false
+}
+
+// Select returns the packages with the mappings selected by `groups` and `without`.
+// Packages without selected mappings are omitted.
+func Select(packages []RequiredPackage, groups []string, without []string) []RequiredPackage {
+	selected := make([]RequiredPackage, 0, len(packages))
+	for _, pkg := range packages {
+		mappings := make([]ReqiuredMapping, 0, len(pkg.Mappings))
+		for _, m := range pkg.Mappings {
+			if Selected(pkg, m, groups, without) {
+				mappings = append(mappings, m)
+			}
+		}
+		if len(mappings) > 0 {
+			pkg.Mappings = mappings
+			selected = append(selected, pkg)
+		}
+	}
+	return selected
+}
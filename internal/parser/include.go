@@ -0,0 +1,218 @@
+package parser
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Include refers to a requirements file, which is either local or located within a git repository
+type Include struct {
+	// Src is a repository url, `path` is a local file when it is empty
+	Src     string `yaml:"src,omitempty"`
+	Path    string `yaml:"path"`
+	Version string `yaml:"version,omitempty"`
+
+	node *yaml.Node
+}
+
+// FetchFunc reads the file `path` from the repository `url` at `version`
+type FetchFunc func(url string, version string, path string) ([]byte, error)
+
+func (inc *Include) UnmarshalYAML(value *yaml.Node) error {
+	type plain Include
+	if err := value.Decode((*plain)(inc)); err != nil {
+		return err
+	}
+	inc.node = value
+	return nil
+}
+
+func (inc Include) String() string {
+	if inc.Src == "" {
+		return inc.Path
+	}
+	s := inc.Src
+	if inc.Version != "" {
+		s += "@" + inc.Version
+	}
+	return s + "#" + inc.Path
+}
+
+// resolve makes `inc` absolute relatively to the requirements which refer to it. Local includes
+// of a remote file are located within the same repository at the same version.
+func (r *Requirements) resolve(inc Include) Include {
+	if inc.Src != "" {
+		return inc
+	}
+	if r.remote != nil {
+		if !path.IsAbs(inc.Path) {
+			inc.Path = path.Join(path.Dir(r.remote.Path), inc.Path)
+		}
+		inc.Src, inc.Version = r.remote.Src, r.remote.Version
+		return inc
+	}
+	if !filepath.IsAbs(inc.Path) {
+		inc.Path = filepath.Join(filepath.Dir(r.Filename), inc.Path)
+	}
+	if abs, err := filepath.Abs(inc.Path); err == nil {
+		inc.Path = abs
+	}
+	return inc
+}
+
+// load reads the included requirements with the same options. Nested includes are resolved as well.
+func (r *Requirements) load(inc Include) (child *Requirements, err error) {
+	var data []byte
+
+	inc = r.resolve(inc)
+	key := inc.String()
+	for _, parent := range r.parents {
+		if parent == key {
+			return nil, fmt.Errorf("%s is included recursively", key)
+		}
+	}
+	child = &Requirements{
+		Filename:  inc.Path,
+		Galaxy:    r.Galaxy,
+		Variables: r.Variables,
+		Fetch:     r.Fetch,
+		parents:   append(append([]string{}, r.parents...), key),
+	}
+	if inc.Src == "" {
+		data, err = ioutil.ReadFile(inc.Path)
+	} else {
+		if r.Fetch == nil {
+			return nil, fmt.Errorf("remote includes are not supported")
+		}
+		child.Filename = key
+		child.remote = &inc
+		data, err = r.Fetch(inc.Src, inc.Version, inc.Path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return child, child.Read(bytes.NewReader(data))
+}
+
+// mapped describes a destination which is already taken by a package mapping
+type mapped struct {
+	url     string
+	mapping ReqiuredMapping
+	// from is a name of the file where the mapping is defined
+	from string
+	// overridable mappings come from `extends` and can be overridden by the current file
+	overridable bool
+}
+
+func (m mapped) conflicts(url string, mapping ReqiuredMapping) bool {
+	return m.url != url || m.mapping.Src != mapping.Src || m.mapping.Version != mapping.Version ||
+		strings.Join(m.mapping.Patches, "\n") != strings.Join(mapping.Patches, "\n")
+}
+
+// compose merges the requirements from `extends` and `include` into `included`. Mappings from different
+// files to the same destination must be identical, otherwise they are reported as conflicts. The current
+// file may override the mappings from `extends` only.
+func (r *Requirements) compose() error {
+	var errs ValidationErrors
+
+	r.included = nil
+	if r.Extends == nil && len(r.Include) == 0 {
+		return nil
+	}
+	base := &Requirements{}
+	dests := make(map[string]mapped)
+
+	merge := func(inc Include, overridable bool) {
+		child, err := r.load(inc)
+		if err != nil {
+			if verrs, ok := err.(ValidationErrors); ok {
+				errs = append(errs, verrs...)
+			} else {
+				errs = append(errs, newValidationError(r.Filename, inc.node, "include %s: %s", inc, err))
+			}
+			return
+		}
+		for _, pkg := range child.AllPackages() {
+			for _, m := range pkg.Mappings {
+				dest := path.Clean(m.Dest)
+				if prev, ok := dests[dest]; ok {
+					if prev.conflicts(pkg.Url, m) {
+						errs = append(errs, newValidationError(r.Filename, inc.node,
+							"conflict on dest %s: %s@%s from %s and %s@%s from %s",
+							m.Dest, prev.url, prev.mapping.Version, prev.from, pkg.Url, m.Version, inc))
+					}
+					continue
+				}
+				dests[dest] = mapped{url: pkg.Url, mapping: m, from: inc.String(), overridable: overridable}
+				base.Add(flatten(pkg, m))
+			}
+		}
+	}
+
+	if r.Extends != nil {
+		merge(*r.Extends, true)
+	}
+	for _, inc := range r.Include {
+		merge(inc, false)
+	}
+	for _, pkg := range r.Packages {
+		for _, m := range pkg.Mappings {
+			if prev, ok := dests[path.Clean(m.Dest)]; ok && !prev.overridable && prev.conflicts(pkg.Url, m) {
+				errs = append(errs, newValidationError(r.Filename, keyNode(m.node, "dest"),
+					"conflict on dest %s: %s@%s from %s and %s@%s",
+					m.Dest, prev.url, prev.mapping.Version, prev.from, pkg.Url, m.Version))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		errs.sort()
+		return errs
+	}
+	r.included = base.Packages
+	return nil
+}
+
+// AllPackages returns the packages along with the packages of included files. Mappings of the current
+// file take precedence over the included ones with the same destination.
+func (r *Requirements) AllPackages() []RequiredPackage {
+	if len(r.included) == 0 {
+		return r.Packages
+	}
+	all := &Requirements{}
+	for _, pkg := range r.included {
+		pkg.Mappings = append([]ReqiuredMapping{}, pkg.Mappings...)
+		all.Packages = append(all.Packages, pkg)
+	}
+	for _, pkg := range r.Packages {
+		for _, m := range pkg.Mappings {
+			all.removeDest(m.Dest)
+			all.Add(flatten(pkg, m))
+		}
+	}
+	return all.Packages
+}
+
+// removeDest removes mappings to `dest`, packages without mappings are removed as well
+func (r *Requirements) removeDest(dest string) {
+	dest = path.Clean(dest)
+	packages := r.Packages[:0]
+	for _, pkg := range r.Packages {
+		mappings := pkg.Mappings[:0]
+		for _, m := range pkg.Mappings {
+			if path.Clean(m.Dest) != dest {
+				mappings = append(mappings, m)
+			}
+		}
+		pkg.Mappings = mappings
+		if len(pkg.Mappings) > 0 {
+			packages = append(packages, pkg)
+		}
+	}
+	r.Packages = packages
+}
@@ -0,0 +1,123 @@
+package parser
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// varPattern matches ${VAR} and ${VAR:-default}, `$${` is an escaped `${`
+var varPattern = regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// lookupVar returns a value of the variable `name`. Variables passed from the command line
+// take precedence over the environment, the environment takes precedence over the `vars` section.
+func (r *Requirements) lookupVar(name string) (string, bool) {
+	if v, ok := r.Variables[name]; ok {
+		return v, true
+	}
+	if v, ok := os.LookupEnv(name); ok {
+		return v, true
+	}
+	v, ok := r.Vars[name]
+	return v, ok
+}
+
+// interpolate expands variables within `s` with `lookup`. An undefined variable without a default is an error.
+func interpolate(s string, lookup func(string) (string, bool)) (string, error) {
+	var err error
+
+	result := varPattern.ReplaceAllStringFunc(s, func(match string) string {
+		if strings.HasPrefix(match, "$$") {
+			return match[1:]
+		}
+		groups := varPattern.FindStringSubmatch(match)
+		if v, ok := lookup(groups[1]); ok {
+			return v
+		}
+		if groups[2] != "" {
+			return groups[3]
+		}
+		if err == nil {
+			err = fmt.Errorf("variable %s is not defined", groups[1])
+		}
+		return match
+	})
+	return result, err
+}
+
+// Interpolate expands ${VAR} and ${VAR:-default} within urls, versions, sources, destinations, templates,
+// patches and includes.
+// Values of the `vars` section can refer to the environment and command line variables.
+// The read document is not changed, so the variables are kept on writing.
+func (r *Requirements) Interpolate() error {
+	var errs ValidationErrors
+
+	expand := func(value *string, node *yaml.Node, key string, lookup func(string) (string, bool)) {
+		v, err := interpolate(*value, lookup)
+		if err != nil {
+			errs = append(errs, newValidationError(r.Filename, keyNode(node, key), "%s", err))
+			return
+		}
+		*value = v
+	}
+
+	outer := func(name string) (string, bool) {
+		if v, ok := r.Variables[name]; ok {
+			return v, true
+		}
+		return os.LookupEnv(name)
+	}
+	for name, value := range r.Vars {
+		expand(&value, r.topNode("vars"), name, outer)
+		r.Vars[name] = value
+	}
+
+	includes := make([]*Include, 0, len(r.Include)+1)
+	if r.Extends != nil {
+		includes = append(includes, r.Extends)
+	}
+	for k := range r.Include {
+		includes = append(includes, &r.Include[k])
+	}
+	for _, inc := range includes {
+		expand(&inc.Src, inc.node, "src", r.lookupVar)
+		expand(&inc.Path, inc.node, "path", r.lookupVar)
+		expand(&inc.Version, inc.node, "version", r.lookupVar)
+	}
+
+	for url, version := range r.Overrides {
+		expand(&version, r.topNode("overrides"), url, r.lookupVar)
+		r.Overrides[url] = version
+	}
+
+	for k := range r.Packages {
+		pkg := &r.Packages[k]
+		expand(&pkg.Url, pkg.node, "src", r.lookupVar)
+		for i := range pkg.Mappings {
+			m := &pkg.Mappings[i]
+			expand(&m.Src, m.node, "src", r.lookupVar)
+			expand(&m.Dest, m.node, "dest", r.lookupVar)
+			expand(&m.Version, m.node, "version", r.lookupVar)
+			for j := range m.Patches {
+				expand(&m.Patches[j], m.node, "patches", r.lookupVar)
+			}
+			if m.Template != nil {
+				values := valueNode(m.node, "template")
+				expand(&m.Template.Files, values, "files", r.lookupVar)
+				for name, value := range m.Template.Values {
+					expand(&value, valueNode(values, "values"), name, r.lookupVar)
+					m.Template.Values[name] = value
+				}
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		errs.sort()
+		return errs
+	}
+	return nil
+}
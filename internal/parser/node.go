@@ -0,0 +1,68 @@
+package parser
+
+import "gopkg.in/yaml.v3"
+
+// sequenceNode returns a sequence value of `key` within the mapping `node`.
+// The key is added when it is missing or its value is null.
+func sequenceNode(node *yaml.Node, key string) *yaml.Node {
+	if v := valueNode(node, key); v != nil {
+		if v.Kind != yaml.SequenceNode {
+			*v = yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq", Line: v.Line, Column: v.Column}
+		}
+		return v
+	}
+	v := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+	node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, v)
+	return v
+}
+
+// setValue sets a scalar value of `key` within the mapping `node`, the key is added when it is missing.
+// Comments of an existing value are kept.
+func setValue(node *yaml.Node, key string, value string) {
+	if v := valueNode(node, key); v != nil {
+		v.Kind, v.Tag, v.Value, v.Style, v.Content = yaml.ScalarNode, "!!str", value, 0, nil
+		return
+	}
+	node.Content = append(node.Content,
+		&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key},
+		&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value},
+	)
+}
+
+// appendNode encodes `v` and appends it to the sequence `seq`
+func appendNode(seq *yaml.Node, v interface{}) *yaml.Node {
+	node := &yaml.Node{}
+	// values are plain structs, so encoding can not fail
+	node.Encode(v)
+	seq.Content = append(seq.Content, node)
+	return node
+}
+
+// updateMappingNode changes values of the mapping node which differ between `prev` and `next`
+func updateMappingNode(node *yaml.Node, prev ReqiuredMapping, next ReqiuredMapping) {
+	if node == nil {
+		return
+	}
+	if prev.Src != next.Src {
+		setValue(node, "src", next.Src)
+	}
+	if prev.Dest != next.Dest {
+		setValue(node, "dest", next.Dest)
+	}
+	if prev.Version != next.Version {
+		setValue(node, "version", next.Version)
+	}
+}
+
+// removeNode removes `node` from the sequence `seq`
+func removeNode(seq *yaml.Node, node *yaml.Node) {
+	if seq == nil || node == nil {
+		return
+	}
+	for k, v := range seq.Content {
+		if v == node {
+			seq.Content = append(seq.Content[:k], seq.Content[k+1:]...)
+			return
+		}
+	}
+}
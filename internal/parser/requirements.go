@@ -2,43 +2,270 @@ package parser
 
 import (
 	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 
-	"gopkg.in/yaml.v2"
+	"gopkg.in/yaml.v3"
 )
 
 type ReqiuredMapping struct {
 	Src     string `yaml:"src"`
 	Dest    string `yaml:"dest"`
-	Version string `yaml:"version"`
+	Version string `yaml:"version,omitempty"`
+	// Groups allow to install a subset of requirements
+	Groups []string `yaml:"groups,omitempty,flow"`
+	// Hooks are run around installation and removal of the mapping
+	Hooks *Hooks `yaml:"hooks,omitempty"`
+	// Template renders files of the mapping, the mapping is installed as a copy then
+	Template *Template `yaml:"template,omitempty"`
+	// Patches are unified diff files which are applied to the mapping source. Relative paths are located
+	// next to the requirements file and resolved on reading.
+	Patches []string `yaml:"patches,omitempty"`
+
+	node *yaml.Node
+}
+
+// Template describes files which are rendered with Go text/template and values
+type Template struct {
+	// Files is a glob relative to the mapping source, `**` matches any number of directories.
+	// A glob without slashes matches base names of files.
+	Files  string            `yaml:"files"`
+	Values map[string]string `yaml:"values,omitempty"`
+}
+
+// Hooks are shell commands, they are not interpolated, so variables of the hook environment can be used
+type Hooks struct {
+	PreInstall  string `yaml:"pre_install,omitempty"`
+	PostInstall string `yaml:"post_install,omitempty"`
+	PreRemove   string `yaml:"pre_remove,omitempty"`
 }
 
 type RequiredPackage struct {
 	Url      string            `yaml:"src"`
 	Mappings []ReqiuredMapping `yaml:"mappings"`
+	// Groups are applied to all mappings of the package
+	Groups []string `yaml:"groups,omitempty,flow"`
+
+	node *yaml.Node
 }
 
+// Requirements keep the YAML document they are read from, so modifications change only
+// the affected nodes and comments and ordering are preserved on writing.
 type Requirements struct {
-	Packages []RequiredPackage `yaml:"packages"`
+	// Vars are default values of variables used within the requirements
+	Vars map[string]string `yaml:"vars,omitempty"`
+	// Extends refers to requirements which mappings can be overridden by this file
+	Extends *Include `yaml:"extends,omitempty"`
+	// Include refers to requirements which are merged with this file
+	Include []Include `yaml:"include,omitempty"`
+	// Overrides force versions of packages by their urls, they are used from the root requirements only
+	Overrides map[string]string `yaml:"overrides,omitempty"`
+	Packages  []RequiredPackage `yaml:"packages"`
+	// Hooks are run around installation and removal of the package which contains the requirements
+	Hooks *Hooks `yaml:"hooks,omitempty"`
+	// Filename is used to report positions of errors
+	Filename string `yaml:"-"`
+	// Format of the read file
+	Format Format `yaml:"-"`
+	// Galaxy describes how ansible-galaxy requirements are mapped to packages
+	Galaxy GalaxyOptions `yaml:"-"`
+	// Variables override Vars and the environment, e.g. they are passed from the command line
+	Variables map[string]string `yaml:"-"`
+	// Fetch is used to read remote includes
+	Fetch FetchFunc `yaml:"-"`
+	// BaseDir locates relative patches, the directory of Filename is used by default
+	BaseDir string `yaml:"-"`
+
+	doc *yaml.Node
+	// remote is set when the requirements are read from a repository
+	remote *Include
+	// parents are the files which include the requirements, they are used to detect cycles
+	parents []string
+	// included are the merged packages from `extends` and `include`
+	included []RequiredPackage
+}
+
+func (m *ReqiuredMapping) UnmarshalYAML(value *yaml.Node) error {
+	type plain ReqiuredMapping
+	if err := value.Decode((*plain)(m)); err != nil {
+		return err
+	}
+	m.node = value
+	return nil
 }
 
+func (p *RequiredPackage) UnmarshalYAML(value *yaml.Node) error {
+	type plain RequiredPackage
+	if err := value.Decode((*plain)(p)); err != nil {
+		return err
+	}
+	p.node = value
+	return nil
+}
+
+// Read decodes requirements from `reader`. Unknown fields and invalid values are reported
+// as ValidationErrors with their positions. Requirements in ansible-galaxy format are detected
+// and mapped to packages according to Galaxy options. Included files are read as well,
+// local ones are located relatively to Filename.
 func (r *Requirements) Read(reader io.Reader) (err error) {
-	temp := &Requirements{}
+	var (
+		data []byte
+		doc  yaml.Node
+	)
+	temp := &Requirements{Filename: r.Filename}
+	r.Format = NativeFormat
+	r.doc = nil
 
-	err = yaml.NewDecoder(reader).Decode(temp)
+	if data, err = ioutil.ReadAll(reader); err != nil {
+		return
+	}
+	if err = yaml.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	if len(doc.Content) == 0 {
+		// empty document
+		r.Packages = nil
+		r.Vars = nil
+		r.Extends = nil
+		r.Include = nil
+		r.Overrides = nil
+		r.Hooks = nil
+		r.included = nil
+		if doc.Kind == yaml.DocumentNode {
+			r.doc = &doc
+		}
+		return nil
+	}
+	if isGalaxy(doc.Content[0]) {
+		if err = r.readGalaxy(doc.Content[0]); err != nil {
+			return err
+		}
+		if err = r.Interpolate(); err != nil {
+			return err
+		}
+		if err = r.Validate(); err != nil {
+			return err
+		}
+		return r.compose()
+	}
+	// unknown fields are reported along with the errors found by Validate
+	fieldErrs := checkFields(r.Filename, doc.Content[0], temp)
+	if err = doc.Content[0].Decode(temp); err != nil {
+		if len(fieldErrs) > 0 {
+			return fieldErrs
+		}
+		return err
+	}
+	r.Packages = temp.Packages
+	r.Vars = temp.Vars
+	r.Extends = temp.Extends
+	r.Include = temp.Include
+	r.Overrides = temp.Overrides
+	r.Hooks = temp.Hooks
+	r.doc = &doc
 
-	if temp != nil {
-		r.Packages = temp.Packages
+	if err = r.Interpolate(); err != nil {
+		if len(fieldErrs) > 0 {
+			return fieldErrs
+		}
+		return err
+	}
+	if err = r.Validate(); err != nil || len(fieldErrs) > 0 {
+		errs, _ := err.(ValidationErrors)
+		errs = append(fieldErrs, errs...)
+		errs.sort()
+		return errs
+	}
+	if err = r.resolvePatches(); err != nil {
+		return err
 	}
+	return r.compose()
+}
+
+// resolvePatches makes relative patches of the mappings absolute. Patches are not supported within remote files.
+func (r *Requirements) resolvePatches() error {
+	var errs ValidationErrors
 
-	// TODO: validate
-	return err
+	base := r.BaseDir
+	if base == "" {
+		base = filepath.Dir(r.Filename)
+	}
+	for k := range r.Packages {
+		for i := range r.Packages[k].Mappings {
+			m := &r.Packages[k].Mappings[i]
+			if len(m.Patches) > 0 && r.remote != nil {
+				errs = append(errs, newValidationError(r.Filename, keyNode(m.node, "patches"), "patches are not supported within remote requirements"))
+				continue
+			}
+			for j, p := range m.Patches {
+				if !filepath.IsAbs(p) {
+					p = filepath.Join(base, p)
+				}
+				if abs, err := filepath.Abs(p); err == nil {
+					p = abs
+				}
+				m.Patches[j] = p
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
 }
 
+// Write encodes the requirements. The read document is written with its comments and ordering,
+// otherwise the requirements are encoded from scratch.
 func (r *Requirements) Write(writer io.Writer) (err error) {
-	err = yaml.NewEncoder(writer).Encode(r)
+	var v interface{} = r
+
+	encoder := yaml.NewEncoder(writer)
+	encoder.SetIndent(2)
+	if r.editable() {
+		v = r.doc
+	}
+	if err = encoder.Encode(v); err != nil {
+		return
+	}
+	err = encoder.Close()
 	return
 }
 
+// WriteFile writes the requirements to a temporary file next to `filename` and then renames it,
+// so the file is never left truncated. Permissions of an existing file are kept.
+func (r *Requirements) WriteFile(filename string) (err error) {
+	var tmp *os.File
+
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(filename); err == nil {
+		mode = info.Mode().Perm()
+	}
+	if tmp, err = ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename)+".tmp-"); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+	}()
+	if err = r.Write(tmp); err != nil {
+		tmp.Close()
+		return
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return
+	}
+	if err = tmp.Close(); err != nil {
+		return
+	}
+	if err = os.Chmod(tmp.Name(), mode); err != nil {
+		return
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
 func (r *Requirements) SearchByUrl(url string) int {
 	for k, v := range r.Packages {
 		if v.Url == url {
@@ -61,19 +288,94 @@ func (r *Requirements) SearchByMapping(url string, m ReqiuredMapping) int {
 	return -1
 }
 
+// Add adds the package or its mappings to the requirements. Existing mappings with the same src and dest
+// are updated. Only the affected nodes of the read document are changed.
 func (r *Requirements) Add(p RequiredPackage) {
 	urlIndex := r.SearchByUrl(p.Url)
 
 	if urlIndex == -1 {
+		if r.editable() {
+			p.node = appendNode(r.packagesNode(), p)
+			mappings := valueNode(p.node, "mappings")
+			for k := range p.Mappings {
+				p.Mappings[k].node = mappings.Content[k]
+			}
+		}
 		r.Packages = append(r.Packages, p)
 		return
 	}
+	pkg := &r.Packages[urlIndex]
 	for _, v := range p.Mappings {
 		mappingIndex := r.SearchByMapping(p.Url, v)
+		if !r.editable() || pkg.node == nil {
+			if mappingIndex == -1 {
+				pkg.Mappings = append(pkg.Mappings, v)
+			} else {
+				pkg.Mappings[mappingIndex] = v
+			}
+			continue
+		}
 		if mappingIndex == -1 {
-			r.Packages[urlIndex].Mappings = append(r.Packages[urlIndex].Mappings, v)
+			v.node = appendNode(sequenceNode(pkg.node, "mappings"), v)
+			pkg.Mappings = append(pkg.Mappings, v)
 		} else {
-			r.Packages[urlIndex].Mappings[mappingIndex] = v
+			v.node = pkg.Mappings[mappingIndex].node
+			updateMappingNode(v.node, pkg.Mappings[mappingIndex], v)
+			pkg.Mappings[mappingIndex] = v
 		}
 	}
 }
+
+// Remove removes mappings with the destination from the packages of the file, packages without mappings
+// are removed as well. Included packages are not changed. It reports whether any mapping is removed.
+func (r *Requirements) Remove(dest string) (removed bool) {
+	packages := make([]RequiredPackage, 0, len(r.Packages))
+	for _, pkg := range r.Packages {
+		mappings := make([]ReqiuredMapping, 0, len(pkg.Mappings))
+		for _, m := range pkg.Mappings {
+			if filepath.Clean(m.Dest) != filepath.Clean(dest) {
+				mappings = append(mappings, m)
+				continue
+			}
+			if r.editable() && pkg.node != nil {
+				removeNode(valueNode(pkg.node, "mappings"), m.node)
+			}
+		}
+		if len(mappings) == len(pkg.Mappings) {
+			packages = append(packages, pkg)
+			continue
+		}
+		removed = true
+		if len(mappings) == 0 {
+			if r.editable() {
+				removeNode(r.topNode("packages"), pkg.node)
+			}
+			continue
+		}
+		pkg.Mappings = mappings
+		packages = append(packages, pkg)
+	}
+	r.Packages = packages
+	return
+}
+
+// editable reports whether the read document can be changed in place
+func (r *Requirements) editable() bool {
+	return r.doc != nil && r.Format != GalaxyFormat
+}
+
+// packagesNode returns the `packages` sequence of the document, missing nodes are created
+func (r *Requirements) packagesNode() *yaml.Node {
+	if len(r.doc.Content) == 0 {
+		r.doc.Content = append(r.doc.Content, &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"})
+	}
+	return sequenceNode(r.doc.Content[0], "packages")
+}
+
+// topNode returns a value of the top level `key` within the read document
+func (r *Requirements) topNode(key string) *yaml.Node {
+	if r.doc == nil || len(r.doc.Content) == 0 {
+		return nil
+	}
+	return valueNode(r.doc.Content[0], key)
+}
@@ -2,6 +2,9 @@ package parser
 
 import (
 	"bytes"
+	"os"
+	"path"
+	"path/filepath"
 	"strings"
 	"testing"
 )
@@ -51,3 +54,605 @@ func TestWriteCorrectRequirements(t *testing.T) {
 	}
 	t.Log(writer.String())
 }
+
+func TestParseUnknownField(t *testing.T) {
+	requirements := `
+packages:
+- src: https://github.com/k1nky/ansible-simple-roles.git
+  mappings:
+    - src: motd
+      dest: roles/motd
+      verison: master
+`
+	req := &Requirements{Filename: "requirements.yml"}
+	err := req.Read(strings.NewReader(requirements))
+	errs, ok := err.(ValidationErrors)
+	if !ok || len(errs) != 1 {
+		t.Fatalf("expected one validation error, got %v", err)
+	}
+	if want := `requirements.yml:7:7: unknown field "verison"`; errs[0].Error() != want {
+		t.Errorf("got %q, want %q", errs[0].Error(), want)
+	}
+}
+
+func TestParseUnknownFieldWithInvalidDest(t *testing.T) {
+	requirements := `
+packages:
+- src: https://github.com/k1nky/ansible-simple-roles.git
+  mappings:
+    - src: motd
+      dest: ../motd
+      verison: master
+`
+	req := &Requirements{Filename: "requirements.yml"}
+	err := req.Read(strings.NewReader(requirements))
+	errs, ok := err.(ValidationErrors)
+	if !ok || len(errs) != 2 {
+		t.Fatalf("expected two validation errors, got %v", err)
+	}
+	want := []string{
+		"requirements.yml:6:13: invalid dest: path ../motd points outside of the directory",
+		`requirements.yml:7:7: unknown field "verison"`,
+	}
+	for i := range want {
+		if errs[i].Error() != want[i] {
+			t.Errorf("got %q, want %q", errs[i].Error(), want[i])
+		}
+	}
+}
+
+func TestValidateRequirements(t *testing.T) {
+	requirements := `
+packages:
+- src: https://github.com/k1nky/ansible-simple-roles.git
+  mappings:
+    - src: motd
+      dest: roles/motd
+    - src: motd
+      dest: ../../etc
+    - src: etchosts
+      dest: roles/motd/
+    - src: etchosts
+- src: "https://exa mple"
+  mappings:
+    - dest: roles/example
+`
+	want := []string{
+		"8:13: invalid dest",
+		"10:13: duplicate dest",
+		"11:7: dest is required",
+		"12:8: url",
+	}
+	err := (&Requirements{}).Read(strings.NewReader(requirements))
+	errs, ok := err.(ValidationErrors)
+	if !ok || len(errs) != len(want) {
+		t.Fatalf("expected %d validation errors, got %v", len(want), err)
+	}
+	for k, v := range want {
+		if !strings.HasPrefix(errs[k].Error(), v) {
+			t.Errorf("got %q, want %q", errs[k].Error(), v)
+		}
+	}
+}
+
+func TestParseGalaxyRequirements(t *testing.T) {
+	requirements := `
+roles:
+  - src: https://github.com/k1nky/ansible-simple-role.git
+    version: v1.0
+    name: simple
+  - src: git+https://github.com/k1nky/ansible-simple-roles.git,master
+collections:
+  - name: https://github.com/k1nky/ns.collection.git
+    type: git
+    version: dev
+`
+	req := &Requirements{Galaxy: GalaxyOptions{RolesPath: "ansible/roles"}}
+	if err := req.Read(strings.NewReader(requirements)); err != nil {
+		t.Fatal(err)
+	}
+	if req.Format != GalaxyFormat {
+		t.Errorf("expected galaxy format, got %s", req.Format)
+	}
+	want := []struct {
+		url string
+		mpg ReqiuredMapping
+	}{
+		{"https://github.com/k1nky/ansible-simple-role.git", ReqiuredMapping{Src: ".", Dest: "ansible/roles/simple", Version: "v1.0"}},
+		{"https://github.com/k1nky/ansible-simple-roles.git", ReqiuredMapping{Src: ".", Dest: "ansible/roles/ansible-simple-roles", Version: "master"}},
+		{"https://github.com/k1nky/ns.collection.git", ReqiuredMapping{Src: ".", Dest: "collections/ansible_collections/ns/collection", Version: "dev"}},
+	}
+	for _, w := range want {
+		if req.SearchByMapping(w.url, w.mpg) == -1 {
+			t.Errorf("mapping %v of %s is not found", w.mpg, w.url)
+		}
+	}
+}
+
+func TestParseGalaxyUnsupported(t *testing.T) {
+	requirements := `
+- src: geerlingguy.java
+`
+	err := (&Requirements{}).Read(strings.NewReader(requirements))
+	if errs, ok := err.(ValidationErrors); !ok || len(errs) != 1 || errs[0].Line != 2 {
+		t.Errorf("expected an error at line 2, got %v", err)
+	}
+}
+
+func TestAddPreservesComments(t *testing.T) {
+	requirements := `# shared roles
+packages:
+  - src: https://github.com/k1nky/ansible-simple-roles.git
+    mappings:
+      - src: motd # message of the day
+        dest: roles/motd
+        version: master # pinned later
+`
+	req := &Requirements{}
+	if err := req.Read(strings.NewReader(requirements)); err != nil {
+		t.Fatal(err)
+	}
+	req.Add(RequiredPackage{
+		Url: "https://github.com/k1nky/ansible-simple-roles.git",
+		Mappings: []ReqiuredMapping{
+			{Src: "motd", Dest: "roles/motd", Version: "v1.0"},
+			{Src: "etchosts", Dest: "roles/etchosts"},
+		},
+	})
+	req.Add(RequiredPackage{
+		Url:      "https://github.com/k1nky/ansible-simple-role.git",
+		Mappings: []ReqiuredMapping{{Src: ".", Dest: "roles/simple", Version: "master"}},
+	})
+	writer := bytes.NewBufferString("")
+	if err := req.Write(writer); err != nil {
+		t.Fatal(err)
+	}
+	want := `# shared roles
+packages:
+  - src: https://github.com/k1nky/ansible-simple-roles.git
+    mappings:
+      - src: motd # message of the day
+        dest: roles/motd
+        version: v1.0 # pinned later
+      - src: etchosts
+        dest: roles/etchosts
+  - src: https://github.com/k1nky/ansible-simple-role.git
+    mappings:
+      - src: .
+        dest: roles/simple
+        version: master
+`
+	if writer.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", writer.String(), want)
+	}
+}
+
+func TestRemove(t *testing.T) {
+	requirements := `# shared roles
+packages:
+  - src: https://github.com/k1nky/ansible-simple-roles.git
+    mappings:
+      - src: motd # message of the day
+        dest: roles/motd
+      - src: etchosts
+        dest: roles/etchosts
+  - src: https://github.com/k1nky/ansible-simple-role.git # the last one
+    mappings:
+      - dest: roles/simple
+`
+	req := &Requirements{}
+	if err := req.Read(strings.NewReader(requirements)); err != nil {
+		t.Fatal(err)
+	}
+	if req.Remove("roles/missing") {
+		t.Error("missing destination is not expected to be removed")
+	}
+	if !req.Remove("roles/etchosts") || !req.Remove("roles/simple/") {
+		t.Fatal("mappings are expected to be removed")
+	}
+	writer := bytes.NewBufferString("")
+	if err := req.Write(writer); err != nil {
+		t.Fatal(err)
+	}
+	want := `# shared roles
+packages:
+  - src: https://github.com/k1nky/ansible-simple-roles.git
+    mappings:
+      - src: motd # message of the day
+        dest: roles/motd
+`
+	if writer.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", writer.String(), want)
+	}
+	if len(req.Packages) != 1 || len(req.Packages[0].Mappings) != 1 {
+		t.Errorf("unexpected packages %+v", req.Packages)
+	}
+}
+
+func TestWriteFile(t *testing.T) {
+	filename := path.Join(t.TempDir(), "requirements.yml")
+	if err := os.WriteFile(filename, []byte("packages: []\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	req := &Requirements{}
+	req.Add(RequiredPackage{
+		Url:      "https://github.com/k1nky/ansible-simple-role.git",
+		Mappings: []ReqiuredMapping{{Src: ".", Dest: "roles/simple"}},
+	})
+	if err := req.WriteFile(filename); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("file mode is expected to be kept, got %s", info.Mode())
+	}
+	entries, _ := os.ReadDir(path.Dir(filename))
+	if len(entries) != 1 {
+		t.Errorf("temporary files are expected to be removed, got %d entries", len(entries))
+	}
+}
+
+func TestInterpolate(t *testing.T) {
+	requirements := `
+vars:
+  org: k1nky
+  branch: ${APM_TEST_BRANCH:-master}
+packages:
+- src: https://github.com/${org}/ansible-simple-roles.git
+  mappings:
+    - src: motd
+      dest: ${ROLES_DIR:-roles}/motd
+      version: ${branch}
+    - src: ntp
+      dest: roles/$${literal}
+      version: ${APM_TEST_VERSION}
+`
+	os.Setenv("APM_TEST_VERSION", "v1.0")
+	defer os.Unsetenv("APM_TEST_VERSION")
+
+	req := &Requirements{Variables: map[string]string{"org": "other"}}
+	if err := req.Read(strings.NewReader(requirements)); err != nil {
+		t.Fatal(err)
+	}
+	pkg := req.Packages[0]
+	if pkg.Url != "https://github.com/other/ansible-simple-roles.git" {
+		t.Errorf("unexpected url %s", pkg.Url)
+	}
+	if m := pkg.Mappings[0]; m.Dest != "roles/motd" || m.Version != "master" {
+		t.Errorf("unexpected mapping %+v", m)
+	}
+	if m := pkg.Mappings[1]; m.Dest != "roles/${literal}" || m.Version != "v1.0" {
+		t.Errorf("unexpected mapping %+v", m)
+	}
+
+	// variables are kept on writing
+	writer := bytes.NewBufferString("")
+	if err := req.Write(writer); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(writer.String(), "https://github.com/${org}/ansible-simple-roles.git") {
+		t.Errorf("variables are expanded on writing:\n%s", writer.String())
+	}
+}
+
+func TestInterpolateUndefined(t *testing.T) {
+	requirements := `
+packages:
+- src: https://github.com/k1nky/ansible-simple-roles.git
+  mappings:
+    - src: motd
+      dest: roles/motd
+      version: ${APM_TEST_UNDEFINED}
+`
+	req := &Requirements{Filename: "requirements.yml"}
+	err := req.Read(strings.NewReader(requirements))
+	errs, ok := err.(ValidationErrors)
+	if !ok || len(errs) != 1 {
+		t.Fatalf("expected one validation error, got %v", err)
+	}
+	if errs[0].Line != 7 || !strings.Contains(errs[0].Message, "APM_TEST_UNDEFINED") {
+		t.Errorf("unexpected error %s", errs[0])
+	}
+}
+
+func writeTestFile(t *testing.T, dir string, name string, content string) string {
+	filename := path.Join(dir, name)
+	if err := os.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestInclude(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "base.yml", `
+packages:
+- src: https://github.com/k1nky/base.git
+  mappings:
+    - src: motd
+      dest: roles/motd
+      version: v1.0
+    - src: ntp
+      dest: roles/ntp
+      version: v1.0
+`)
+	writeTestFile(t, dir, "common.yml", `
+include:
+  - src: https://github.com/k1nky/platform.git
+    path: requirements.yml
+    version: v2.0
+`)
+	filename := writeTestFile(t, dir, "requirements.yml", `
+extends:
+  path: base.yml
+include:
+  - path: common.yml
+packages:
+- src: https://github.com/k1nky/base.git
+  mappings:
+    - src: ntp
+      dest: roles/ntp
+      version: v1.1
+`)
+	fetched := ""
+	req := &Requirements{Filename: filename}
+	req.Fetch = func(url string, version string, p string) ([]byte, error) {
+		fetched = url + "@" + version + "#" + p
+		return []byte(`
+packages:
+- src: https://github.com/k1nky/platform.git
+  mappings:
+    - src: users
+      dest: roles/users
+`), nil
+	}
+	data, _ := os.ReadFile(filename)
+	if err := req.Read(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if fetched != "https://github.com/k1nky/platform.git@v2.0#requirements.yml" {
+		t.Errorf("unexpected fetched file %s", fetched)
+	}
+	versions := make(map[string]string)
+	for _, pkg := range req.AllPackages() {
+		for _, m := range pkg.Mappings {
+			versions[m.Dest] = m.Version
+		}
+	}
+	want := map[string]string{"roles/motd": "v1.0", "roles/ntp": "v1.1", "roles/users": ""}
+	if len(versions) != len(want) {
+		t.Errorf("unexpected packages %v", versions)
+	}
+	for dest, version := range want {
+		if v, ok := versions[dest]; !ok || v != version {
+			t.Errorf("unexpected version of %s: %v", dest, v)
+		}
+	}
+	if len(req.Packages) != 1 {
+		t.Error("included packages are merged into the file")
+	}
+}
+
+func TestIncludeConflict(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "base.yml", `
+packages:
+- src: https://github.com/k1nky/base.git
+  mappings:
+    - src: motd
+      dest: roles/motd
+      version: v1.0
+`)
+	writeTestFile(t, dir, "loop.yml", `
+include:
+  - path: loop.yml
+`)
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"include", `
+include:
+  - path: base.yml
+packages:
+- src: https://github.com/k1nky/base.git
+  mappings:
+    - src: motd
+      dest: roles/motd
+      version: v2.0
+`, "conflict on dest roles/motd"},
+		{"same version", `
+include:
+  - path: base.yml
+packages:
+- src: https://github.com/k1nky/base.git
+  mappings:
+    - src: motd
+      dest: roles/motd
+      version: v1.0
+`, ""},
+		{"cycle", `
+include:
+  - path: loop.yml
+`, "included recursively"},
+		{"remote", `
+include:
+  - src: https://github.com/k1nky/platform.git
+    path: requirements.yml
+`, "remote includes are not supported"},
+	}
+	for _, tt := range tests {
+		filename := writeTestFile(t, dir, "requirements.yml", tt.content)
+		req := &Requirements{Filename: filename}
+		err := req.Read(strings.NewReader(tt.content))
+		if tt.want == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error %s", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: expected error %q, got %v", tt.name, tt.want, err)
+		}
+	}
+}
+
+func TestSelectGroups(t *testing.T) {
+	requirements := `
+packages:
+- src: https://github.com/k1nky/ansible-simple-roles.git
+  groups: [dev]
+  mappings:
+    - src: motd
+      dest: roles/motd
+    - src: testing
+      dest: roles/testing
+      groups: [test]
+- src: https://github.com/k1nky/common.git
+  mappings:
+    - src: ntp
+      dest: roles/ntp
+`
+	req := &Requirements{}
+	if err := req.Read(strings.NewReader(requirements)); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		groups  []string
+		without []string
+		want    []string
+	}{
+		{nil, nil, []string{"roles/motd", "roles/testing", "roles/ntp"}},
+		{[]string{"dev"}, []string{"test"}, []string{"roles/motd", "roles/ntp"}},
+		{[]string{"test"}, nil, []string{"roles/testing", "roles/ntp"}},
+		{nil, []string{"dev"}, []string{"roles/ntp"}},
+	}
+	for _, tt := range tests {
+		dests := make([]string, 0)
+		for _, pkg := range Select(req.Packages, tt.groups, tt.without) {
+			for _, m := range pkg.Mappings {
+				dests = append(dests, m.Dest)
+			}
+		}
+		if strings.Join(dests, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("groups %v without %v: got %v, want %v", tt.groups, tt.without, dests, tt.want)
+		}
+	}
+}
+
+func TestParseOverrides(t *testing.T) {
+	requirements := `
+overrides:
+  https://github.com/k1nky/ansible-simple-roles.git: ${APM_TEST_OVERRIDE:-v1.2.0}
+  "not a url": v1.0
+packages: []
+`
+	req := &Requirements{Filename: "requirements.yml"}
+	err := req.Read(strings.NewReader(requirements))
+	errs, ok := err.(ValidationErrors)
+	if !ok || len(errs) != 1 || errs[0].Line != 4 {
+		t.Fatalf("expected an error for the invalid url, got %v", err)
+	}
+	if v := req.Overrides["https://github.com/k1nky/ansible-simple-roles.git"]; v != "v1.2.0" {
+		t.Errorf("unexpected override %s", v)
+	}
+}
+
+func TestParseHooks(t *testing.T) {
+	requirements := `
+hooks:
+  post_install: chmod +x "$APM_DEST/files/run.sh"
+packages:
+  - src: https://github.com/k1nky/ansible-simple-roles.git
+    mappings:
+      - src: motd
+        dest: roles/motd
+        hooks:
+          pre_install: echo ${APM_VERSION}
+          post_remove: echo
+`
+	req := &Requirements{Filename: "requirements.yml"}
+	err := req.Read(strings.NewReader(requirements))
+	errs, ok := err.(ValidationErrors)
+	if !ok || len(errs) != 1 || errs[0].Line != 11 {
+		t.Fatalf("expected an error for the unknown hook, got %v", err)
+	}
+
+	requirements = strings.Replace(requirements, "          post_remove: echo\n", "", 1)
+	if err := req.Read(strings.NewReader(requirements)); err != nil {
+		t.Fatal(err)
+	}
+	if req.Hooks == nil || req.Hooks.PostInstall != `chmod +x "$APM_DEST/files/run.sh"` {
+		t.Errorf("unexpected hooks %+v", req.Hooks)
+	}
+	hooks := req.AllPackages()[0].Mappings[0].Hooks
+	if hooks == nil || hooks.PreInstall != "echo ${APM_VERSION}" {
+		t.Errorf("hooks are expected to be kept uninterpolated, got %+v", hooks)
+	}
+}
+
+func TestParseTemplate(t *testing.T) {
+	t.Setenv("APM_TEST_PORT", "8080")
+	requirements := `
+packages:
+  - src: https://github.com/k1nky/config-skeleton.git
+    mappings:
+      - src: .
+        dest: services/a/config
+        template:
+          files: "**/*.conf"
+          values:
+            port: ${APM_TEST_PORT}
+            name: a
+      - src: .
+        dest: services/b/config
+        template:
+          values:
+            name: b
+`
+	req := &Requirements{Filename: "requirements.yml"}
+	err := req.Read(strings.NewReader(requirements))
+	errs, ok := err.(ValidationErrors)
+	if !ok || len(errs) != 1 || errs[0].Line != 15 {
+		t.Fatalf("expected an error for the missing files, got %v", err)
+	}
+	template := req.Packages[0].Mappings[0].Template
+	if template == nil || template.Files != "**/*.conf" || template.Values["port"] != "8080" || template.Values["name"] != "a" {
+		t.Errorf("unexpected template %+v", template)
+	}
+}
+
+func TestParsePatches(t *testing.T) {
+	t.Setenv("APM_TEST_PATCH", "fix.patch")
+	requirements := `
+packages:
+  - src: https://github.com/k1nky/ansible-simple-roles.git
+    mappings:
+      - src: motd
+        dest: roles/motd
+        patches:
+          - patches/${APM_TEST_PATCH}
+          - /srv/patches/other.patch
+`
+	req := &Requirements{Filename: "config/requirements.yml"}
+	if err := req.Read(strings.NewReader(requirements)); err != nil {
+		t.Fatal(err)
+	}
+	abs, _ := filepath.Abs("config/patches/fix.patch")
+	patches := req.AllPackages()[0].Mappings[0].Patches
+	if len(patches) != 2 || patches[0] != abs || patches[1] != "/srv/patches/other.patch" {
+		t.Errorf("unexpected patches %v", patches)
+	}
+
+	req = &Requirements{Filename: "apm.yml", BaseDir: "/opt/package"}
+	if err := req.Read(strings.NewReader(requirements)); err != nil {
+		t.Fatal(err)
+	}
+	if patches := req.Packages[0].Mappings[0].Patches; patches[0] != "/opt/package/patches/fix.patch" {
+		t.Errorf("patches are expected to be located within the base directory, got %v", patches)
+	}
+}
@@ -0,0 +1,313 @@
+package parser
+
+import (
+	"fmt"
+	gourl "net/url"
+	"path"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ValidationError describes an invalid value within a requirements file
+type ValidationError struct {
+	Filename string `json:"file" yaml:"file"`
+	Line     int    `json:"line" yaml:"line"`
+	Column   int    `json:"column" yaml:"column"`
+	Message  string `json:"message" yaml:"message"`
+}
+
+// ValidationErrors is a list of validation errors ordered by positions
+type ValidationErrors []*ValidationError
+
+var scpLikeUrl = regexp.MustCompile(`^[\w.-]+@[\w.-]+:[^/]`)
+
+func (e *ValidationError) Error() string {
+	pos := ""
+	if e.Line > 0 {
+		pos = fmt.Sprintf("%d:%d: ", e.Line, e.Column)
+	}
+	if e.Filename != "" {
+		pos = e.Filename + ":" + pos
+		if e.Line == 0 {
+			pos += " "
+		}
+	}
+	return pos + e.Message
+}
+
+func (errs ValidationErrors) Error() string {
+	messages := make([]string, 0, len(errs))
+	for _, e := range errs {
+		messages = append(messages, e.Error())
+	}
+	return strings.Join(messages, "\n")
+}
+
+// sort orders the errors by their files and positions
+func (errs ValidationErrors) sort() {
+	sort.SliceStable(errs, func(i, j int) bool {
+		if errs[i].Filename != errs[j].Filename {
+			return errs[i].Filename < errs[j].Filename
+		}
+		if errs[i].Line != errs[j].Line {
+			return errs[i].Line < errs[j].Line
+		}
+		return errs[i].Column < errs[j].Column
+	})
+}
+
+func newValidationError(filename string, node *yaml.Node, format string, a ...interface{}) *ValidationError {
+	e := &ValidationError{
+		Filename: filename,
+		Message:  fmt.Sprintf(format, a...),
+	}
+	if node != nil {
+		e.Line, e.Column = node.Line, node.Column
+	}
+	return e
+}
+
+// knownFields returns struct fields of `t` by their yaml names
+func knownFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			// unexported
+			continue
+		}
+		name := strings.Split(f.Tag.Get("yaml"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		fields[name] = f.Type
+	}
+	return fields
+}
+
+// checkFields walks `node` along with the type of `v` and reports unknown fields and
+// values of unexpected kinds, so misspelled keys do not silently vanish.
+func checkFields(filename string, node *yaml.Node, v interface{}) (errs ValidationErrors) {
+	var walk func(node *yaml.Node, t reflect.Type)
+
+	walk = func(node *yaml.Node, t reflect.Type) {
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		if node.Kind == yaml.AliasNode {
+			node = node.Alias
+		}
+		if node.Kind == yaml.ScalarNode && node.Tag == "!!null" {
+			return
+		}
+		switch t.Kind() {
+		case reflect.Struct:
+			if node.Kind != yaml.MappingNode {
+				errs = append(errs, newValidationError(filename, node, "expected a mapping"))
+				return
+			}
+			fields := knownFields(t)
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				key, value := node.Content[i], node.Content[i+1]
+				if ft, ok := fields[key.Value]; ok {
+					walk(value, ft)
+				} else {
+					errs = append(errs, newValidationError(filename, key, "unknown field %q", key.Value))
+				}
+			}
+		case reflect.Slice:
+			if node.Kind != yaml.SequenceNode {
+				errs = append(errs, newValidationError(filename, node, "expected a list"))
+				return
+			}
+			for _, item := range node.Content {
+				walk(item, t.Elem())
+			}
+		case reflect.Map:
+			if node.Kind != yaml.MappingNode {
+				errs = append(errs, newValidationError(filename, node, "expected a mapping"))
+				return
+			}
+			for i := 1; i < len(node.Content); i += 2 {
+				walk(node.Content[i], t.Elem())
+			}
+		case reflect.Interface:
+		default:
+			if node.Kind != yaml.ScalarNode {
+				errs = append(errs, newValidationError(filename, node, "expected a scalar value"))
+			}
+		}
+	}
+
+	walk(node, reflect.TypeOf(v))
+	return
+}
+
+// valueNode returns a value node of `key` within the mapping `node`
+func valueNode(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// keyNode returns a value node of `key` if it exists, otherwise the mapping `node` itself
+func keyNode(node *yaml.Node, key string) *yaml.Node {
+	if v := valueNode(node, key); v != nil {
+		return v
+	}
+	return node
+}
+
+// ValidateUrl checks that `url` is a valid package url. A scheme is optional.
+func ValidateUrl(url string) error {
+	if url == "" {
+		return fmt.Errorf("url is empty")
+	}
+	if strings.ContainsAny(url, " \t\n") {
+		return fmt.Errorf("url %q contains whitespaces", url)
+	}
+	if scpLikeUrl.MatchString(url) || strings.HasPrefix(url, "/") {
+		return nil
+	}
+	if !strings.Contains(url, "://") {
+		url = "https://" + url
+	}
+	u, err := gourl.Parse(url)
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "http", "https", "ssh", "git", "file":
+	default:
+		return fmt.Errorf("unsupported url scheme %q", u.Scheme)
+	}
+	if u.Host == "" && u.Scheme != "file" {
+		return fmt.Errorf("url %q has no host", url)
+	}
+	return nil
+}
+
+// validateRelativePath checks that `p` stays within its root directory
+func validateRelativePath(p string) error {
+	if path.IsAbs(p) {
+		return fmt.Errorf("path %s must be relative", p)
+	}
+	cleaned := path.Clean(p)
+	if cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return fmt.Errorf("path %s points outside of the directory", p)
+	}
+	return nil
+}
+
+// ValidateSrc checks that the source path `src` stays within the package
+func ValidateSrc(src string) error {
+	return validateRelativePath(src)
+}
+
+// ValidateDest checks that the destination `dest` stays within the working directory and is not reserved
+func ValidateDest(dest string) error {
+	if err := validateRelativePath(dest); err != nil {
+		return err
+	}
+	cleaned := path.Clean(dest)
+	if cleaned == "." || cleaned == ".apm" || strings.HasPrefix(cleaned, ".apm/") {
+		return fmt.Errorf("%s is reserved", dest)
+	}
+	return nil
+}
+
+// Validate checks the requirements: includes, package urls, missing, duplicated and
+// escaping destinations. All found errors are returned as ValidationErrors.
+func (r *Requirements) Validate() error {
+	var errs ValidationErrors
+
+	includes := r.Include
+	if r.Extends != nil {
+		includes = append([]Include{*r.Extends}, includes...)
+	}
+	for _, inc := range includes {
+		if inc.Path == "" {
+			errs = append(errs, newValidationError(r.Filename, inc.node, "include path is required"))
+		}
+		if inc.Src == "" {
+			continue
+		}
+		if err := ValidateUrl(inc.Src); err != nil {
+			errs = append(errs, newValidationError(r.Filename, keyNode(inc.node, "src"), "%s", err))
+		}
+	}
+
+	for url := range r.Overrides {
+		if err := ValidateUrl(url); err != nil {
+			errs = append(errs, newValidationError(r.Filename, keyNode(r.topNode("overrides"), url), "invalid override: %s", err))
+		}
+	}
+
+	dests := make(map[string]*yaml.Node)
+	for _, pkg := range r.Packages {
+		if err := ValidateUrl(pkg.Url); err != nil {
+			errs = append(errs, newValidationError(r.Filename, keyNode(pkg.node, "src"), "%s", err))
+		}
+		if len(pkg.Mappings) == 0 {
+			errs = append(errs, newValidationError(r.Filename, pkg.node, "package %s has no mappings", pkg.Url))
+		}
+		for _, m := range pkg.Mappings {
+			if m.Src != "" {
+				if err := ValidateSrc(m.Src); err != nil {
+					errs = append(errs, newValidationError(r.Filename, keyNode(m.node, "src"), "invalid src: %s", err))
+				}
+			}
+			for _, p := range m.Patches {
+				if p == "" {
+					errs = append(errs, newValidationError(r.Filename, keyNode(m.node, "patches"), "patch path is empty"))
+				}
+			}
+			if m.Template != nil {
+				templateNode := keyNode(m.node, "template")
+				if m.Template.Files == "" {
+					errs = append(errs, newValidationError(r.Filename, templateNode, "template files are required"))
+				} else if _, err := path.Match(m.Template.Files, ""); err != nil {
+					errs = append(errs, newValidationError(r.Filename, keyNode(templateNode, "files"), "invalid template files: %s", err))
+				}
+			}
+			if m.Dest == "" {
+				errs = append(errs, newValidationError(r.Filename, m.node, "dest is required"))
+				continue
+			}
+			destNode := keyNode(m.node, "dest")
+			if err := ValidateDest(m.Dest); err != nil {
+				errs = append(errs, newValidationError(r.Filename, destNode, "invalid dest: %s", err))
+				continue
+			}
+			dest := path.Clean(m.Dest)
+			if prev, ok := dests[dest]; ok {
+				e := newValidationError(r.Filename, destNode, "duplicate dest %s", m.Dest)
+				if prev != nil {
+					e.Message += fmt.Sprintf(", already mapped at line %d", prev.Line)
+				}
+				errs = append(errs, e)
+				continue
+			}
+			dests[dest] = destNode
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	errs.sort()
+	return errs
+}
@@ -0,0 +1,319 @@
+// Package patch applies unified diffs, e.g. made by `diff -u` or `git diff`, to files within a directory
+package patch
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// DevNull is a name of the missing side of created and deleted files
+const DevNull = "/dev/null"
+
+var hunkHeader = regexp.MustCompile(`^@@ -(\d+)(?:,(\d+))? \+(\d+)(?:,(\d+))? @@`)
+
+// File is a diff of one file
+type File struct {
+	OldName string
+	NewName string
+	Hunks   []*Hunk
+}
+
+// Hunk is a changed part of a file. Lines keep their prefixes ' ', '-' or '+' and line endings,
+// a line without the ending is the last one of a file.
+type Hunk struct {
+	OldStart int
+	OldLines int
+	NewStart int
+	NewLines int
+	Lines    []string
+}
+
+// Parse reads diffs of files from `r`. Lines which are not a part of the diffs, e.g. a commit message
+// or git headers, are skipped.
+func Parse(r io.Reader) (files []*File, err error) {
+	var (
+		f    *File
+		hunk *Hunk
+		// old and new are the numbers of lines left within the hunk
+		old, new int
+		lineNo   int
+	)
+
+	scanner := bufio.NewReader(r)
+	for {
+		line, rerr := scanner.ReadString('\n')
+		if line == "" && rerr != nil {
+			if rerr != io.EOF {
+				return nil, rerr
+			}
+			break
+		}
+		lineNo++
+		if hunk != nil && (old > 0 || new > 0) {
+			switch {
+			case line == "\n" || line == "\r\n":
+				// context lines may lose the leading space in editors
+				line = " " + line
+				fallthrough
+			case line[0] == ' ':
+				old, new = old-1, new-1
+			case line[0] == '-':
+				old--
+			case line[0] == '+':
+				new--
+			case strings.HasPrefix(line, `\`):
+				noNewline(hunk)
+				continue
+			default:
+				return nil, fmt.Errorf("line %d: unexpected line within the hunk", lineNo)
+			}
+			if old < 0 || new < 0 {
+				return nil, fmt.Errorf("line %d: the hunk is longer than its header", lineNo)
+			}
+			hunk.Lines = append(hunk.Lines, line)
+			continue
+		}
+		switch {
+		case strings.HasPrefix(line, `\`) && hunk != nil:
+			noNewline(hunk)
+		case strings.HasPrefix(line, "--- "):
+			f = &File{OldName: fileName(line[4:])}
+			hunk = nil
+		case strings.HasPrefix(line, "+++ ") && f != nil && f.NewName == "":
+			f.NewName = fileName(line[4:])
+			files = append(files, f)
+		case strings.HasPrefix(line, "@@ ") && f != nil && f.NewName != "":
+			m := hunkHeader.FindStringSubmatch(line)
+			if m == nil {
+				return nil, fmt.Errorf("line %d: invalid hunk header", lineNo)
+			}
+			hunk = &Hunk{
+				OldStart: atoi(m[1]),
+				OldLines: atoiDefault(m[2], 1),
+				NewStart: atoi(m[3]),
+				NewLines: atoiDefault(m[4], 1),
+			}
+			old, new = hunk.OldLines, hunk.NewLines
+			f.Hunks = append(f.Hunks, hunk)
+		default:
+			hunk = nil
+		}
+	}
+	if hunk != nil && (old > 0 || new > 0) {
+		return nil, fmt.Errorf("line %d: the hunk is truncated", lineNo)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no diffs are found")
+	}
+	return files, nil
+}
+
+// noNewline strips the line ending of the last line of the hunk
+func noNewline(hunk *Hunk) {
+	if n := len(hunk.Lines); n > 0 {
+		hunk.Lines[n-1] = strings.TrimRight(hunk.Lines[n-1], "\r\n")
+	}
+}
+
+// fileName returns a name from the header value, a timestamp after a tab is skipped
+func fileName(s string) string {
+	s = strings.TrimRight(s, "\r\n")
+	if i := strings.Index(s, "\t"); i >= 0 {
+		s = s[:i]
+	}
+	if unquoted, err := strconv.Unquote(s); err == nil {
+		s = unquoted
+	}
+	return s
+}
+
+func atoi(s string) int {
+	n, _ := strconv.Atoi(s)
+	return n
+}
+
+func atoiDefault(s string, def int) int {
+	if s == "" {
+		return def
+	}
+	return atoi(s)
+}
+
+// Name returns a path of the file relative to the patched directory. Prefixes `a/` and `b/` of git diffs are stripped.
+func (f *File) Name() string {
+	name, prefix := f.NewName, "b/"
+	if name == DevNull {
+		name, prefix = f.OldName, "a/"
+	}
+	return strings.TrimPrefix(name, prefix)
+}
+
+// apply returns `content` changed by the hunks. Hunks are looked up near their positions,
+// since the file may have been changed above them.
+func (f *File) apply(content string) (string, error) {
+	lines := splitLines(content)
+	result := make([]string, 0, len(lines))
+	// next is the first line which is not consumed by the previous hunks
+	next := 0
+	offset := 0
+	for k, hunk := range f.Hunks {
+		old, new := hunk.split()
+		start := hunk.OldStart - 1 + offset
+		if len(old) == 0 {
+			// a hunk without old lines inserts after the line OldStart
+			start++
+		}
+		pos := find(lines, old, start, next)
+		if pos < 0 {
+			return "", fmt.Errorf("hunk #%d does not apply at line %d", k+1, hunk.OldStart)
+		}
+		result = append(result, lines[next:pos]...)
+		result = append(result, new...)
+		next = pos + len(old)
+		offset = pos - (hunk.OldStart - 1)
+		if len(old) == 0 {
+			offset--
+		}
+	}
+	result = append(result, lines[next:]...)
+	return strings.Join(result, ""), nil
+}
+
+// split returns the old and the new lines of the hunk without prefixes
+func (h *Hunk) split() (old []string, new []string) {
+	for _, line := range h.Lines {
+		switch line[0] {
+		case ' ':
+			old, new = append(old, line[1:]), append(new, line[1:])
+		case '-':
+			old = append(old, line[1:])
+		case '+':
+			new = append(new, line[1:])
+		}
+	}
+	return
+}
+
+// find returns a position of `old` within `lines` nearest to `start` and not before `min`, or -1
+func find(lines []string, old []string, start int, min int) int {
+	if start < min {
+		start = min
+	}
+	for delta := 0; start-delta >= min || start+delta <= len(lines); delta++ {
+		for _, pos := range []int{start - delta, start + delta} {
+			if pos >= min && pos+len(old) <= len(lines) && equal(lines[pos:pos+len(old)], old) {
+				return pos
+			}
+		}
+	}
+	return -1
+}
+
+func equal(a []string, b []string) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// splitLines splits `s` keeping line endings
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// Apply applies the diffs to files within `dir`. Nothing is written unless all diffs apply.
+func Apply(dir string, files []*File) error {
+	type change struct {
+		name    string
+		content string
+		mode    os.FileMode
+		remove  bool
+	}
+	changes := make([]change, 0, len(files))
+	// patched keeps changed content, so several diffs of the same file are applied in turn
+	patched := make(map[string]*change)
+
+	for _, f := range files {
+		name := path.Clean(f.Name())
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return fmt.Errorf("%s is outside of the directory", f.Name())
+		}
+		target := filepath.Join(dir, filepath.FromSlash(name))
+		c := change{name: target, mode: 0644}
+		if prev, ok := patched[target]; ok {
+			c.content, c.mode = prev.content, prev.mode
+			if prev.remove {
+				return fmt.Errorf("%s: the file is removed", name)
+			}
+		} else if f.OldName != DevNull {
+			info, err := os.Stat(target)
+			if err != nil {
+				return fmt.Errorf("%s: %s", name, err)
+			}
+			data, err := ioutil.ReadFile(target)
+			if err != nil {
+				return err
+			}
+			c.content, c.mode = string(data), info.Mode().Perm()
+		} else if _, err := os.Lstat(target); err == nil {
+			return fmt.Errorf("%s: the created file already exists", name)
+		}
+		content, err := f.apply(c.content)
+		if err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+		c.content, c.remove = content, f.NewName == DevNull
+		if c.remove && content != "" {
+			return fmt.Errorf("%s: the removed file is not empty after the patch", name)
+		}
+		changes = append(changes, c)
+		patched[target] = &changes[len(changes)-1]
+	}
+
+	for _, c := range changes {
+		if c.remove {
+			if err := os.Remove(c.name); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(c.name), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(c.name, []byte(c.content), c.mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ApplyFile applies the diffs read from the file `name` to files within `dir`
+func ApplyFile(dir string, name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	files, err := Parse(f)
+	if err != nil {
+		return err
+	}
+	return Apply(dir, files)
+}
@@ -0,0 +1,102 @@
+package patch
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testDiff = `From: apm <apm@localhost>
+Subject: fix the role
+
+diff --git a/tasks/main.yml b/tasks/main.yml
+index 3b18e51..a7b2f3c 100644
+--- a/tasks/main.yml
++++ b/tasks/main.yml
+@@ -2,3 +2,3 @@
+ - name: first
+-  debug: msg=one
++  debug: msg=fixed
+ - name: second
+@@ -6,2 +6,3 @@
+ - name: third
+   debug: msg=three
++- name: added
+--- /dev/null
++++ b/files/new.txt
+@@ -0,0 +1 @@
++no newline
+\ No newline at end of file
+--- a/files/old.txt
++++ /dev/null
+@@ -1 +0,0 @@
+-old
+`
+
+func TestParse(t *testing.T) {
+	files, err := Parse(strings.NewReader(testDiff))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 {
+		t.Fatalf("unexpected number of files %d", len(files))
+	}
+	if files[0].Name() != "tasks/main.yml" || len(files[0].Hunks) != 2 || len(files[0].Hunks[1].Lines) != 3 {
+		t.Errorf("unexpected diff %+v", files[0])
+	}
+	if files[1].Name() != "files/new.txt" || files[1].Hunks[0].Lines[0] != "+no newline" {
+		t.Errorf("unexpected diff %+v", files[1])
+	}
+	if files[2].Name() != "files/old.txt" {
+		t.Errorf("unexpected diff %+v", files[2])
+	}
+
+	if _, err := Parse(strings.NewReader("--- a/x\n+++ b/x\n@@ -1,2 +1,2 @@\n-a\n+b\n")); err == nil {
+		t.Error("a truncated hunk is expected to be an error")
+	}
+}
+
+func TestApply(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "tasks"), 0755)
+	os.MkdirAll(filepath.Join(dir, "files"), 0755)
+	// the lines above the first hunk are moved by one
+	main := "---\n# moved\n- name: first\n  debug: msg=one\n- name: second\n  debug: msg=two\n- name: third\n  debug: msg=three\n"
+	os.WriteFile(filepath.Join(dir, "tasks/main.yml"), []byte(main), 0644)
+	os.WriteFile(filepath.Join(dir, "files/old.txt"), []byte("old\n"), 0644)
+
+	files, err := Parse(strings.NewReader(testDiff))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Apply(dir, files); err != nil {
+		t.Fatal(err)
+	}
+	expected := "---\n# moved\n- name: first\n  debug: msg=fixed\n- name: second\n  debug: msg=two\n- name: third\n  debug: msg=three\n- name: added\n"
+	if data, _ := os.ReadFile(filepath.Join(dir, "tasks/main.yml")); string(data) != expected {
+		t.Errorf("unexpected content %q", data)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "files/new.txt")); string(data) != "no newline" {
+		t.Errorf("unexpected content %q", data)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "files/old.txt")); !os.IsNotExist(err) {
+		t.Error("the file is expected to be removed")
+	}
+
+	// the same diff does not apply anymore and nothing is changed
+	os.WriteFile(filepath.Join(dir, "files/old.txt"), []byte("old\n"), 0644)
+	os.Remove(filepath.Join(dir, "files/new.txt"))
+	err = Apply(dir, files)
+	if err == nil || !strings.Contains(err.Error(), "tasks/main.yml: hunk #1 does not apply at line 2") {
+		t.Errorf("unexpected error %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "files/new.txt")); !os.IsNotExist(err) {
+		t.Error("nothing is expected to be written when a diff does not apply")
+	}
+
+	escaping := []*File{{OldName: DevNull, NewName: "b/../../x", Hunks: files[1].Hunks}}
+	if err := Apply(dir, escaping); err == nil {
+		t.Error("a file outside of the directory is expected to be an error")
+	}
+}